@@ -1,40 +1,74 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"net/url"
 	"os"
 	"os/signal"
 
+	"github.com/moorzeen/loyalty-service/internal/logging"
 	"github.com/moorzeen/loyalty-service/internal/server"
 	"github.com/moorzeen/loyalty-service/internal/storage/postgres"
+	"github.com/moorzeen/loyalty-service/internal/tracing"
 )
 
 func main() {
 	cfg, err := server.GetConfig()
 	if err != nil {
-		log.Fatalf("Failed to get configuration: %s", err)
+		fatal("Failed to get configuration", err)
 	}
 
-	log.Printf(
-		"Starting configuration:\n- run address: %s\n- database URI: %s\n- accrual system address: %s\n",
-		cfg.RunAddress, cfg.DatabaseURI, cfg.AccrualAddress)
+	err = logging.Setup(os.Stderr, cfg.LogLevel)
+	if err != nil {
+		fatal("Failed to set up logging", err)
+	}
+
+	slog.Info("Starting configuration",
+		"run_address", cfg.RunAddress,
+		"database_uri", redactURI(cfg.DatabaseURI),
+		"accrual_system_address", cfg.AccrualAddress)
+
+	shutdownTracing, err := tracing.Init(context.Background(), cfg.TracingExporter)
+	if err != nil {
+		fatal("Failed to init tracing", err)
+	}
 
 	err = postgres.Migration(cfg.DatabaseURI)
 	if err != nil {
-		log.Fatalf("Failed to migrate DB: %s", err)
+		fatal("Failed to migrate DB", err)
 	}
 
 	ls, err := server.NewServer(cfg)
 	if err != nil {
-		log.Fatalf("Failed to init the server: %s", err)
+		fatal("Failed to init the server", err)
 	}
 
 	ls.Run()
-	log.Println("Server is listening and serving...")
+	slog.Info("Server is listening and serving...")
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, os.Interrupt)
 	<-quit
 
-	log.Println("Server stopped")
+	err = shutdownTracing(context.Background())
+	if err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+
+	slog.Info("Server stopped")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// redactURI hides the password of the database URI.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return logging.Redacted
+	}
+	return u.Redacted()
 }
@@ -1,30 +1,67 @@
 package accrual
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/logging"
+	"github.com/moorzeen/loyalty-service/internal/metrics"
+	"github.com/moorzeen/loyalty-service/internal/points"
 	"github.com/moorzeen/loyalty-service/internal/storage"
+	"github.com/moorzeen/loyalty-service/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Service struct {
-	client      *Client
-	storage     storage.Service
-	tick        *time.Ticker      // Тикер для проверки наличия заказов в буфере
-	orderBuffer map[string]string // Буфер заказов для обработки
-	stopChan    chan struct{}     // Канал для сигнала о приостановке опроса
-	mutex       *sync.Mutex
+	provider      Provider
+	storage       storage.Service
+	events        events.Publisher
+	tick          *time.Ticker         // Тикер для проверки наличия заказов в буфере
+	orderBuffer   map[string]time.Time // Буфер заказов для обработки и время их следующего опроса
+	stopChan      chan struct{}        // Канал для сигнала о приостановке опроса
+	mutex         *sync.Mutex
+	callbackGrace time.Duration // Время ожидания обратного вызова перед опросом
+	worker        *WorkerStats  // Состояние фоновой обработки, защищено mutex
+	expiry        points.Policy // Срок действия начисленных баллов
+	bonuses       []Bonus       // Дополнительные начисления к обработанным заказам
 }
 
-func NewService(str storage.Service, cli *Client) Service {
+// Bonus adds credits to the accrual of a processed order. It is called in the
+// transaction crediting the accrual, credits without an expiry get the default
+// one and credits without a user go to the order owner.
+type Bonus interface {
+	Bonuses(ctx context.Context, tx storage.Tx, userID uint64, accrual storage.Accrual) ([]storage.Credit, error)
+}
+
+// WorkerStats is a snapshot of the background order processing.
+type WorkerStats struct {
+	Polling    bool      `json:"polling"`
+	Queue      int       `json:"queue"`
+	Started    time.Time `json:"started"`
+	LastScan   time.Time `json:"last_scan,omitempty"` // last successful check for new orders
+	ScanErrors int       `json:"scan_errors"`         // failed checks in a row
+}
+
+// NewService starts polling of unprocessed orders. With a non-zero callbackGrace
+// an order is polled only when no accrual callback has arrived for that long.
+func NewService(str storage.Service, provider Provider, pub events.Publisher, callbackGrace time.Duration, expiry points.Policy, bonuses ...Bonus) Service {
 	acc := Service{
-		client:      cli,
-		storage:     str,
-		tick:        time.NewTicker(time.Second),
-		orderBuffer: make(map[string]string, 0),
-		stopChan:    make(chan struct{}),
-		mutex:       &sync.Mutex{},
+		provider:      provider,
+		storage:       str,
+		events:        pub,
+		tick:          time.NewTicker(time.Second),
+		orderBuffer:   make(map[string]time.Time, 0),
+		stopChan:      make(chan struct{}),
+		mutex:         &sync.Mutex{},
+		callbackGrace: callbackGrace,
+		worker:        &WorkerStats{Started: time.Now()},
+		expiry:        expiry,
+		bonuses:       bonuses,
 	}
 
 	go acc.receivingUnprocessed()
@@ -33,50 +70,75 @@ func NewService(str storage.Service, cli *Client) Service {
 	return acc
 }
 
+// Stats returns the state of the background order processing.
+func (s *Service) Stats() WorkerStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := *s.worker
+	stats.Queue = len(s.orderBuffer)
+	return stats
+}
+
 func (s *Service) manage() {
 	for {
 		select {
 		case <-s.tick.C:
-			if len(s.orderBuffer) > 0 {
+			s.mutex.Lock()
+			buffered := len(s.orderBuffer)
+			s.mutex.Unlock()
+			if buffered > 0 {
+				s.setPolling(true)
 				s.tick.Stop()
 				go s.polling()
-				log.Println("Start polling")
+				slog.Info("Start polling")
 			}
 		case <-s.stopChan:
+			s.setPolling(false)
 			s.tick.Reset(time.Second)
-			log.Println("Stop polling")
+			slog.Info("Stop polling")
 		}
 	}
 }
 
 // receivingUnprocessed – select orders with PROCESSING and NEW status
 func (s *Service) receivingUnprocessed() {
-	processingOrders, err := s.storage.GetProcessingOrders()
+	processingOrders, err := s.storage.GetProcessingOrders(context.Background())
 	if err != nil {
-		log.Println(err)
+		slog.Error("Failed to get processing orders", "error", err)
 	}
 
 	if len(processingOrders) > 0 {
 		for _, order := range processingOrders {
 			s.mutex.Lock()
-			s.orderBuffer[order] = order
+			s.orderBuffer[order] = time.Now()
+			metrics.AccrualQueueDepth.Set(float64(len(s.orderBuffer)))
 			s.mutex.Unlock()
-			log.Println("processing order", order, "added to buffer")
+			slog.Debug("Processing order added to buffer", "order_number", order)
 		}
 	}
 
 	for {
-		newOrders, err := s.storage.GetNewOrders()
+		newOrders, err := s.storage.GetNewOrders(context.Background())
+		s.mutex.Lock()
 		if err != nil {
-			log.Println(err)
+			s.worker.ScanErrors++
+		} else {
+			s.worker.LastScan = time.Now()
+			s.worker.ScanErrors = 0
+		}
+		s.mutex.Unlock()
+		if err != nil {
+			slog.Error("Failed to get new orders", "error", err)
 		}
 
 		if len(newOrders) > 0 {
 			for _, order := range newOrders {
 				s.mutex.Lock()
-				s.orderBuffer[order] = order
+				s.orderBuffer[order] = time.Now().Add(s.callbackGrace)
+				metrics.AccrualQueueDepth.Set(float64(len(s.orderBuffer)))
 				s.mutex.Unlock()
-				log.Println("new order", order, "added to buffer")
+				slog.Debug("New order added to buffer", "order_number", order)
 			}
 		}
 
@@ -84,64 +146,195 @@ func (s *Service) receivingUnprocessed() {
 	}
 }
 
+func (s *Service) setPolling(polling bool) {
+	s.mutex.Lock()
+	s.worker.Polling = polling
+	s.mutex.Unlock()
+}
+
 func (s *Service) polling() {
 	for {
 		s.mutex.Lock()
-		buffer := s.orderBuffer
+		if len(s.orderBuffer) == 0 {
+			s.mutex.Unlock()
+			s.stopChan <- struct{}{}
+			return
+		}
+
+		now := time.Now()
+		due := make([]string, 0, len(s.orderBuffer))
+		for n, at := range s.orderBuffer {
+			if !at.After(now) {
+				due = append(due, n)
+			}
+		}
 		s.mutex.Unlock()
 
-		if len(buffer) > 0 {
-			for _, n := range buffer {
-				accrual, accErr := s.client.GetAccrual(n)
-				s.responseHandler(accrual, accErr)
-				time.Sleep(time.Second * 1)
+		// orders of a provider with an open circuit or rate limited wait in the buffer
+		polled := 0
+		for _, n := range due {
+			if gate, ok := s.provider.(Gate); ok && !gate.Allow(n) {
+				continue
 			}
-		} else {
-			s.stopChan <- struct{}{}
-			return
+			s.poll(n)
+			polled++
+			time.Sleep(time.Second * 1)
 		}
+
+		if polled == 0 {
+			time.Sleep(time.Second * 1)
+		}
+	}
+}
+
+// poll requests the accrual of the order under its own root span.
+func (s *Service) poll(orderNumber string) {
+	ctx := logging.WithOrderNumber(context.Background(), orderNumber)
+	ctx, span := tracing.Tracer().Start(ctx, "accrual.poll",
+		trace.WithNewRoot(),
+		trace.WithAttributes(tracing.OrderNumber.String(orderNumber)),
+	)
+	defer span.End()
+
+	accrual, accErr := s.provider.GetAccrual(ctx, orderNumber)
+	if accErr != nil {
+		tracing.Fail(span, accErr)
 	}
+	s.responseHandler(ctx, accrual, accErr)
 }
 
-func (s *Service) responseHandler(accrual storage.Accrual, accErr error) {
+func (s *Service) responseHandler(ctx context.Context, accrual storage.Accrual, accErr error) {
+	metrics.AccrualPolls.WithLabelValues(pollOutcome(accrual, accErr)).Inc()
+
 	if accErr != nil {
-		log.Println(accErr)
+		if errors.Is(accErr, ErrTooManyRequests) {
+			metrics.AccrualRateLimited.Inc()
+		}
+		slog.WarnContext(ctx, "Failed to get accrual", "error", accErr)
 		return
 	}
 
-	if accrual.Status == "PROCESSED" {
-		userID, err := s.storage.UpdateOrder(accrual)
+	_, err := s.Apply(ctx, accrual)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to apply accrual", "error", err)
+	}
+}
+
+// Apply stores an accrual result received either by polling or by a callback.
+// It is idempotent: the balance is credited only on the transition to PROCESSED,
+// and final statuses are never overwritten. It reports whether the order changed.
+func (s *Service) Apply(ctx context.Context, accrual storage.Accrual) (bool, error) {
+	if !isAccrualStatus(accrual.Status) {
+		return false, fmt.Errorf("%w \"%s\" of order %s", ErrUnknownStatus, accrual.Status, accrual.OrderNumber)
+	}
+
+	var (
+		userID  uint64
+		changed bool
+		accrued float64
+		bonuses []storage.Credit
+	)
+	err := s.storage.WithTx(ctx, func(tx storage.Tx) error {
+		var err error
+		userID, changed, err = tx.UpdateOrder(ctx, accrual)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
 
-		err = s.storage.Accrual(userID, accrual.Accrual)
-		if err != nil {
-			log.Println(err)
-			return
+		if !changed || accrual.Status != "PROCESSED" {
+			return nil
 		}
-		s.mutex.Lock()
-		delete(s.orderBuffer, accrual.OrderNumber)
-		s.mutex.Unlock()
-	}
 
-	if accrual.Status == "INVALID" {
-		_, err := s.storage.UpdateOrder(accrual)
-		if err != nil {
-			log.Println(err)
-			return
+		credits := []storage.Credit{{Kind: storage.LedgerAccrual, Amount: accrual.Accrual}}
+		for _, b := range s.bonuses {
+			extra, err := b.Bonuses(ctx, tx, userID, accrual)
+			if err != nil {
+				return err
+			}
+			credits = append(credits, extra...)
 		}
-		s.mutex.Lock()
+
+		expiresAt := s.expiry.ExpiresAt(time.Now())
+		accrued, bonuses = 0, nil
+		for i, c := range credits {
+			if i > 0 && c.Amount <= 0 {
+				continue
+			}
+			if c.UserID == 0 {
+				c.UserID = userID
+			}
+			if c.UserID == userID {
+				c.OrderNumber = accrual.OrderNumber
+			}
+			if c.ExpiresAt.IsZero() {
+				c.ExpiresAt = expiresAt
+			}
+			err = tx.Accrual(ctx, c)
+			if err != nil {
+				return err
+			}
+			accrued += c.Amount
+			if i > 0 {
+				bonuses = append(bonuses, c)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	metrics.PointsAccrued.Add(accrued)
+
+	s.mutex.Lock()
+	switch {
+	case userID == 0 || accrual.Status == "PROCESSED" || accrual.Status == "INVALID":
 		delete(s.orderBuffer, accrual.OrderNumber)
-		s.mutex.Unlock()
+		metrics.AccrualQueueDepth.Set(float64(len(s.orderBuffer)))
+	default:
+		if _, ok := s.orderBuffer[accrual.OrderNumber]; ok {
+			s.orderBuffer[accrual.OrderNumber] = time.Now().Add(s.callbackGrace)
+		}
 	}
+	s.mutex.Unlock()
 
-	if accrual.Status == "REGISTERED" || accrual.Status == "PROCESSING" {
-		_, err := s.storage.UpdateOrder(accrual)
-		if err != nil {
-			log.Println(err)
-			return
+	if userID == 0 {
+		return false, fmt.Errorf("%w %s", ErrUnknownOrder, accrual.OrderNumber)
+	}
+
+	if changed {
+		s.publish(ctx, events.OrderStatusChanged, userID, "", accrual)
+		if accrual.Status == "PROCESSED" {
+			s.publish(ctx, events.BalanceAccrued, userID, storage.LedgerAccrual, accrual)
+		}
+		for _, c := range bonuses {
+			bonus := storage.Accrual{OrderNumber: c.OrderNumber, Status: accrual.Status, Accrual: c.Amount}
+			s.publish(ctx, events.BalanceAccrued, c.UserID, c.Kind, bonus)
 		}
 	}
+
+	return changed, nil
+}
+
+// publish sends an event of the accrual, kind tells bonuses from the accrual itself.
+func (s *Service) publish(ctx context.Context, eventType string, userID uint64, kind string, accrual storage.Accrual) {
+	if s.events == nil {
+		return
+	}
+
+	e := events.Event{
+		Type:        eventType,
+		UserID:      userID,
+		OrderNumber: accrual.OrderNumber,
+		Status:      accrual.Status,
+		Amount:      accrual.Accrual,
+		Kind:        kind,
+		Time:        time.Now(),
+	}
+
+	err := s.events.Publish(ctx, e)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to publish accrual event", "event", eventType, "error", err)
+	}
 }
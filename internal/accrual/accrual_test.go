@@ -0,0 +1,97 @@
+package accrual
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// creditStorage records the credits of an order owned by user 1.
+type creditStorage struct {
+	storage.Service
+	credits []storage.Credit
+}
+
+func (s *creditStorage) WithTx(_ context.Context, fn func(tx storage.Tx) error) error {
+	return fn(s)
+}
+
+func (s *creditStorage) UpdateOrder(context.Context, storage.Accrual) (uint64, bool, error) {
+	return 1, true, nil
+}
+
+func (s *creditStorage) Accrual(_ context.Context, credit storage.Credit) error {
+	s.credits = append(s.credits, credit)
+	return nil
+}
+
+type recorder struct {
+	events []events.Event
+}
+
+func (r *recorder) Publish(_ context.Context, e events.Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+type fixedBonus []storage.Credit
+
+func (b fixedBonus) Bonuses(context.Context, storage.Tx, uint64, storage.Accrual) ([]storage.Credit, error) {
+	return b, nil
+}
+
+func TestApplyBonusKinds(t *testing.T) {
+	str := &creditStorage{}
+	pub := &recorder{}
+	s := Service{
+		storage:     str,
+		events:      pub,
+		orderBuffer: map[string]time.Time{},
+		mutex:       &sync.Mutex{},
+		worker:      &WorkerStats{},
+		bonuses: []Bonus{fixedBonus{
+			{Kind: storage.LedgerTierBonus, Amount: 5},
+			{UserID: 2, Kind: storage.LedgerReferral, Amount: 50},
+			{Kind: storage.LedgerCampaign, Amount: 0},
+		}},
+	}
+
+	changed, err := s.Apply(context.Background(), storage.Accrual{OrderNumber: "12345678903", Status: "PROCESSED", Accrual: 100})
+	if err != nil || !changed {
+		t.Fatalf("got %v, %v; want changed", changed, err)
+	}
+
+	wantCredits := []storage.Credit{
+		{UserID: 1, Kind: storage.LedgerAccrual, OrderNumber: "12345678903", Amount: 100},
+		{UserID: 1, Kind: storage.LedgerTierBonus, OrderNumber: "12345678903", Amount: 5},
+		{UserID: 2, Kind: storage.LedgerReferral, Amount: 50},
+	}
+	if len(str.credits) != len(wantCredits) {
+		t.Fatalf("got credits %+v, want %+v", str.credits, wantCredits)
+	}
+	for i, c := range wantCredits {
+		if str.credits[i] != c {
+			t.Errorf("credit %d: got %+v, want %+v", i, str.credits[i], c)
+		}
+	}
+
+	var kinds []string
+	for _, e := range pub.events {
+		if e.Type == events.BalanceAccrued {
+			kinds = append(kinds, e.Kind)
+		}
+	}
+	wantKinds := []string{storage.LedgerAccrual, storage.LedgerTierBonus, storage.LedgerReferral}
+	if len(kinds) != len(wantKinds) {
+		t.Fatalf("got accrued kinds %v, want %v", kinds, wantKinds)
+	}
+	for i := range wantKinds {
+		if kinds[i] != wantKinds[i] {
+			t.Errorf("event %d: got kind %s, want %s", i, kinds[i], wantKinds[i])
+		}
+	}
+}
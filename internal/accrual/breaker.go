@@ -0,0 +1,175 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/metrics"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half-open"
+)
+
+// Gate reports whether an order may be polled now. The poller keeps orders
+// whose provider is unavailable in the buffer without calling it.
+type Gate interface {
+	Allow(orderNumber string) bool
+}
+
+// Breaker is a circuit breaker around a provider. After threshold failures
+// in a row the circuit opens and calls fail fast for coolDown. Then a single
+// trial call is let through in the half-open state: its success closes the
+// circuit and its failure opens it again. Rate limiting is not a failure,
+// calls are paused for the Retry-After delay instead.
+type Breaker struct {
+	name      string
+	provider  Provider
+	threshold int
+	coolDown  time.Duration
+
+	state    string
+	failures int
+	openedAt time.Time
+	paused   time.Time // rate limited until
+	trial    bool      // the half-open trial call is in flight
+	trips    uint64
+	rejected uint64
+	mutex    *sync.Mutex
+}
+
+// BreakerStats is a snapshot of the breaker state.
+type BreakerStats struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+	Paused   time.Time `json:"paused_until,omitempty"`
+	Trips    uint64    `json:"trips"`
+	Rejected uint64    `json:"rejected"`
+}
+
+func NewBreaker(name string, p Provider, threshold int, coolDown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return &Breaker{
+		name:      name,
+		provider:  p,
+		threshold: threshold,
+		coolDown:  coolDown,
+		state:     StateClosed,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+func (b *Breaker) GetAccrual(ctx context.Context, orderNumber string) (storage.Accrual, error) {
+	if !b.acquire() {
+		return storage.Accrual{}, ErrCircuitOpen
+	}
+
+	start := time.Now()
+	accrual, err := b.provider.GetAccrual(ctx, orderNumber)
+	metrics.AccrualProviderDuration.WithLabelValues(b.name).Observe(time.Since(start).Seconds())
+	b.record(err)
+
+	return accrual, err
+}
+
+// Allow reports whether a call would pass without consuming the trial call.
+func (b *Breaker) Allow(string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if time.Now().Before(b.paused) {
+		return false
+	}
+
+	switch b.state {
+	case StateOpen:
+		return time.Since(b.openedAt) >= b.coolDown
+	case StateHalfOpen:
+		return !b.trial
+	default:
+		return true
+	}
+}
+
+func (b *Breaker) Stats() BreakerStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return BreakerStats{
+		Name:     b.name,
+		State:    b.state,
+		Failures: b.failures,
+		OpenedAt: b.openedAt,
+		Paused:   b.paused,
+		Trips:    b.trips,
+		Rejected: b.rejected,
+	}
+}
+
+func (b *Breaker) acquire() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == StateOpen && time.Since(b.openedAt) >= b.coolDown {
+		b.setState(StateHalfOpen)
+	}
+
+	switch {
+	case time.Now().Before(b.paused) || b.state == StateOpen || (b.state == StateHalfOpen && b.trial):
+		b.rejected++
+		return false
+	case b.state == StateHalfOpen:
+		b.trial = true
+	}
+
+	return true
+}
+
+// record counts the call result. Unregistered orders are a valid answer
+// of a working accrual system, so they are not failures. Neither is rate
+// limiting, which pauses the calls and keeps the state.
+func (b *Breaker) record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+
+	var rl *RateLimitError
+	if errors.As(err, &rl) {
+		b.paused = time.Now().Add(rl.RetryAfter)
+		return
+	}
+
+	if err == nil || errors.Is(err, ErrNotRegistered) {
+		b.failures = 0
+		if b.state != StateClosed {
+			b.setState(StateClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == StateHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		if b.state != StateOpen {
+			b.trips++
+			b.setState(StateOpen)
+		}
+	}
+}
+
+func (b *Breaker) setState(state string) {
+	slog.Warn("Accrual provider circuit changed", "provider", b.name, "from", b.state, "to", state)
+	b.state = state
+}
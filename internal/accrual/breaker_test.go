@@ -0,0 +1,139 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+type stubProvider struct {
+	err   error
+	calls int
+}
+
+func (p *stubProvider) GetAccrual(_ context.Context, orderNumber string) (storage.Accrual, error) {
+	p.calls++
+	return storage.Accrual{OrderNumber: orderNumber, Status: "PROCESSED"}, p.err
+}
+
+func TestBreakerTrips(t *testing.T) {
+	p := &stubProvider{err: ErrUnavailable}
+	b := NewBreaker("test", p, 2, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.GetAccrual(context.Background(), "1"); !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("call %d: got %v, want ErrUnavailable", i, err)
+		}
+	}
+
+	if s := b.Stats(); s.State != StateOpen || s.Trips != 1 {
+		t.Fatalf("got state %s with %d trips, want open with 1", s.State, s.Trips)
+	}
+	if b.Allow("1") {
+		t.Error("open circuit allows calls")
+	}
+	if _, err := b.GetAccrual(context.Background(), "1"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got %v, want ErrCircuitOpen", err)
+	}
+	if p.calls != 2 {
+		t.Errorf("provider called %d times, want 2", p.calls)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	p := &stubProvider{err: ErrUnavailable}
+	b := NewBreaker("test", p, 1, 0)
+
+	b.GetAccrual(context.Background(), "1")
+	if s := b.Stats(); s.State != StateOpen {
+		t.Fatalf("got state %s, want open", s.State)
+	}
+
+	p.err = nil
+	if !b.Allow("1") {
+		t.Fatal("trial call is not allowed after the cool down")
+	}
+	if _, err := b.GetAccrual(context.Background(), "1"); err != nil {
+		t.Fatalf("trial call failed: %v", err)
+	}
+	if s := b.Stats(); s.State != StateClosed || s.Failures != 0 {
+		t.Errorf("got state %s with %d failures, want closed with 0", s.State, s.Failures)
+	}
+}
+
+func TestBreakerRateLimit(t *testing.T) {
+	p := &stubProvider{err: &RateLimitError{RetryAfter: time.Hour}}
+	b := NewBreaker("test", p, 1, 0)
+
+	_, err := b.GetAccrual(context.Background(), "1")
+	if !errors.Is(err, ErrTooManyRequests) {
+		t.Fatalf("got %v, want ErrTooManyRequests", err)
+	}
+
+	s := b.Stats()
+	if s.State != StateClosed || s.Failures != 0 || s.Trips != 0 {
+		t.Errorf("rate limit counted as failure: %+v", s)
+	}
+	if time.Until(s.Paused) < 59*time.Minute {
+		t.Errorf("paused until %s, want an hour from now", s.Paused)
+	}
+	if b.Allow("1") {
+		t.Error("rate limited provider allows calls")
+	}
+
+	p.err = nil
+	if _, err = b.GetAccrual(context.Background(), "1"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got %v, want ErrCircuitOpen", err)
+	}
+	if p.calls != 1 {
+		t.Errorf("provider called %d times, want 1", p.calls)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"60", time.Minute},
+		{" 5 ", 5 * time.Second},
+		{"", defaultRetryAfter},
+		{"0", defaultRetryAfter},
+		{"-1", defaultRetryAfter},
+		{"soon", defaultRetryAfter},
+		{"86400", maxRetryAfter},
+		{now.Add(2 * time.Minute).Format(http.TimeFormat), 2 * time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), defaultRetryAfter},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestClientRateLimited(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	_, err := NewClient(srv.URL).GetAccrual(context.Background(), "12345678903")
+
+	var rl *RateLimitError
+	if !errors.As(err, &rl) || !errors.Is(err, ErrTooManyRequests) {
+		t.Fatalf("got %v, want RateLimitError", err)
+	}
+	if rl.RetryAfter != 30*time.Second {
+		t.Errorf("got retry after %s, want 30s", rl.RetryAfter)
+	}
+}
@@ -1,12 +1,16 @@
 package accrual
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/moorzeen/loyalty-service/internal/storage"
+	"github.com/moorzeen/loyalty-service/internal/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Client struct {
@@ -24,8 +28,21 @@ func NewClient(addr string) *Client {
 	}
 }
 
-func (c *Client) GetAccrual(orderNumber string) (storage.Accrual, error) {
-	accrual := storage.Accrual{}
+func (c *Client) GetAccrual(ctx context.Context, orderNumber string) (accrual storage.Accrual, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "accrual.GetAccrual",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			tracing.OrderNumber.String(orderNumber),
+			semconv.HTTPMethodKey.String(http.MethodGet),
+			semconv.HTTPURLKey.String(c.Address+"/api/orders/"+orderNumber),
+		),
+	)
+	defer func() {
+		if err != nil {
+			tracing.Fail(span, err)
+		}
+		span.End()
+	}()
 
 	type responseJSON struct {
 		OrderNumber string  `json:"order"`
@@ -34,11 +51,28 @@ func (c *Client) GetAccrual(orderNumber string) (storage.Accrual, error) {
 	}
 	response := responseJSON{}
 
-	resp, err := c.Get(c.Address + "/api/orders/" + orderNumber)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Address+"/api/orders/"+orderNumber, nil)
+	if err != nil {
+		return accrual, err
+	}
+
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := c.Do(req)
 	if err != nil {
 		return accrual, fmt.Errorf("failed request accrual server: %w", err)
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return accrual, fmt.Errorf("%w: %s", ErrNotRegistered, orderNumber)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return accrual, &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	case resp.StatusCode != http.StatusOK:
+		return accrual, fmt.Errorf("%w: status %d", ErrUnavailable, resp.StatusCode)
+	}
 
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
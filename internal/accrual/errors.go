@@ -0,0 +1,35 @@
+package accrual
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrUnknownStatus = errors.New("unknown accrual status")
+	ErrUnknownOrder  = errors.New("unknown order")
+	ErrBadSignature  = errors.New("invalid accrual callback signature")
+	ErrNotRegistered = errors.New("order is not registered in the accrual system")
+
+	ErrTooManyRequests = errors.New("accrual system rate limit exceeded")
+	ErrUnavailable     = errors.New("accrual system is unavailable")
+	ErrCircuitOpen     = errors.New("accrual system circuit is open")
+
+	ErrBadProviderConfig = errors.New("invalid accrual provider config")
+	ErrInvalidRule       = errors.New("invalid accrual rule")
+	ErrRuleNotFound      = errors.New("accrual rule not found")
+)
+
+// RateLimitError is ErrTooManyRequests with the delay asked by the accrual system.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: retry after %s", ErrTooManyRequests, e.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrTooManyRequests
+}
@@ -0,0 +1,107 @@
+package accrual
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// callbackMaxSkew limits the age of a signed callback to prevent replays
+const callbackMaxSkew = 5 * time.Minute
+
+// delays of a rate limited provider without or with an excessive Retry-After
+const (
+	defaultRetryAfter = 10 * time.Second
+	maxRetryAfter     = 10 * time.Minute
+)
+
+func isAccrualStatus(s string) bool {
+	switch s {
+	case "REGISTERED", "PROCESSING", "INVALID", "PROCESSED":
+		return true
+	default:
+		return false
+	}
+}
+
+// VerifySignature checks the "sha256=<hex>" signature of a callback body,
+// which is HMAC-SHA256 of "<timestamp>.<body>" with the shared secret.
+func VerifySignature(secret []byte, timestamp string, signature string, body []byte) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > callbackMaxSkew || skew < -callbackMaxSkew {
+		return ErrBadSignature
+	}
+
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return ErrBadSignature
+	}
+
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+
+	if !hmac.Equal(got, h.Sum(nil)) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+// splitList splits a comma separated config value skipping empty items
+func splitList(s string) []string {
+	var result []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// pollOutcome is the metrics label of a poll result: the order status or the error kind
+func pollOutcome(accrual storage.Accrual, err error) string {
+	switch {
+	case err == nil:
+		return accrual.Status
+	case errors.Is(err, ErrNotRegistered):
+		return "not_registered"
+	case errors.Is(err, ErrTooManyRequests):
+		return "rate_limited"
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	default:
+		return "error"
+	}
+}
+
+// parseRetryAfter reads the Retry-After header in seconds or as an HTTP date.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	d := defaultRetryAfter
+	if sec, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && sec >= 0 {
+		d = time.Duration(sec) * time.Second
+	} else if at, err := http.ParseTime(header); err == nil {
+		d = at.Sub(now)
+	}
+
+	switch {
+	case d <= 0:
+		return defaultRetryAfter
+	case d > maxRetryAfter:
+		return maxRetryAfter
+	default:
+		return d
+	}
+}
@@ -0,0 +1,225 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Provider calculates the accrual of an order. The HTTP Client is the
+// provider of the external accrual system.
+type Provider interface {
+	GetAccrual(ctx context.Context, orderNumber string) (storage.Accrual, error)
+}
+
+// StaticProvider returns fixed results, it is meant for tests and demos.
+type StaticProvider struct {
+	accruals map[string]storage.Accrual
+}
+
+func NewStaticProvider(accruals ...storage.Accrual) *StaticProvider {
+	p := &StaticProvider{accruals: make(map[string]storage.Accrual, len(accruals))}
+	for _, a := range accruals {
+		p.accruals[a.OrderNumber] = a
+	}
+	return p
+}
+
+// LoadStaticProvider reads a JSON array of storage.Accrual objects.
+func LoadStaticProvider(path string) (*StaticProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read accrual fixtures: %w", err)
+	}
+
+	var accruals []storage.Accrual
+	err = json.Unmarshal(data, &accruals)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse accrual fixtures: %w", err)
+	}
+
+	return NewStaticProvider(accruals...), nil
+}
+
+func (p *StaticProvider) GetAccrual(_ context.Context, orderNumber string) (storage.Accrual, error) {
+	a, ok := p.accruals[orderNumber]
+	if !ok {
+		return storage.Accrual{}, fmt.Errorf("%w: %s", ErrNotRegistered, orderNumber)
+	}
+	return a, nil
+}
+
+type route struct {
+	prefix   string
+	provider Provider
+}
+
+// Router chooses a provider by the longest matching order number prefix,
+// merchants are told apart by their order number ranges.
+type Router struct {
+	routes   []route
+	fallback Provider
+	breakers []*Breaker
+}
+
+func NewRouter(fallback Provider) *Router {
+	return &Router{fallback: fallback}
+}
+
+// Route sends orders starting with prefix to the provider.
+func (r *Router) Route(prefix string, p Provider) {
+	r.routes = append(r.routes, route{prefix: prefix, provider: p})
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].prefix) > len(r.routes[j].prefix)
+	})
+}
+
+func (r *Router) GetAccrual(ctx context.Context, orderNumber string) (storage.Accrual, error) {
+	return r.provider(orderNumber).GetAccrual(ctx, orderNumber)
+}
+
+// Allow implements Gate by asking the provider of the order.
+func (r *Router) Allow(orderNumber string) bool {
+	if g, ok := r.provider(orderNumber).(Gate); ok {
+		return g.Allow(orderNumber)
+	}
+	return true
+}
+
+// Breakers returns the stats of the circuit breakers of all HTTP providers.
+func (r *Router) Breakers() []BreakerStats {
+	result := make([]BreakerStats, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		result = append(result, b.Stats())
+	}
+	return result
+}
+
+var (
+	breakerStateDesc = prometheus.NewDesc("loyalty_accrual_circuit_state",
+		"Accrual provider circuit state: 0 closed, 1 half-open, 2 open.", []string{"provider"}, nil)
+	breakerTripsDesc = prometheus.NewDesc("loyalty_accrual_circuit_trips_total",
+		"Times the accrual provider circuit opened.", []string{"provider"}, nil)
+	breakerRejectedDesc = prometheus.NewDesc("loyalty_accrual_circuit_rejected_total",
+		"Calls rejected by an open accrual provider circuit.", []string{"provider"}, nil)
+)
+
+// Describe and Collect export the breakers as Prometheus metrics.
+func (r *Router) Describe(ch chan<- *prometheus.Desc) {
+	ch <- breakerStateDesc
+	ch <- breakerTripsDesc
+	ch <- breakerRejectedDesc
+}
+
+func (r *Router) Collect(ch chan<- prometheus.Metric) {
+	for _, st := range r.Breakers() {
+		state := 0.0
+		switch st.State {
+		case StateHalfOpen:
+			state = 1
+		case StateOpen:
+			state = 2
+		}
+		ch <- prometheus.MustNewConstMetric(breakerStateDesc, prometheus.GaugeValue, state, st.Name)
+		ch <- prometheus.MustNewConstMetric(breakerTripsDesc, prometheus.CounterValue, float64(st.Trips), st.Name)
+		ch <- prometheus.MustNewConstMetric(breakerRejectedDesc, prometheus.CounterValue, float64(st.Rejected), st.Name)
+	}
+}
+
+func (r *Router) provider(orderNumber string) Provider {
+	for _, rt := range r.routes {
+		if strings.HasPrefix(orderNumber, rt.prefix) {
+			return rt.provider
+		}
+	}
+	return r.fallback
+}
+
+type ProviderConfig struct {
+	// DefaultAddress is the accrual system of the "default" provider.
+	DefaultAddress string
+	// Providers is a comma separated list of "name=spec" pairs, where spec is
+	// an accrual system address ("http://..." or "https://...") or
+	// "static:<path>" of a fixture file.
+	Providers string
+	// Routes is a comma separated list of "prefix=name" pairs.
+	Routes string
+	// Rules is the local engine available as the "rules" provider.
+	Rules *RulesEngine
+	// BreakerThreshold failures in a row open the circuit of an HTTP
+	// provider for BreakerCoolDown.
+	BreakerThreshold int
+	BreakerCoolDown  time.Duration
+}
+
+// NewProvider builds the order router from config. Orders matching no route
+// go to the "default" provider unless it is redefined in Providers.
+func NewProvider(cfg ProviderConfig) (*Router, error) {
+	specs := map[string]string{"default": cfg.DefaultAddress}
+	names := []string{"default"}
+
+	for _, pair := range splitList(cfg.Providers) {
+		name, spec, ok := strings.Cut(pair, "=")
+		name, spec = strings.TrimSpace(name), strings.TrimSpace(spec)
+		if !ok || name == "" || name == "rules" {
+			return nil, fmt.Errorf("%w: \"%s\"", ErrBadProviderConfig, pair)
+		}
+		if _, ok := specs[name]; !ok {
+			names = append(names, name)
+		}
+		specs[name] = spec
+	}
+
+	named := map[string]Provider{"rules": cfg.Rules}
+	var breakers []*Breaker
+
+	for _, name := range names {
+		p, err := newProvider(specs[name])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.(*Client); ok {
+			b := NewBreaker(name, p, cfg.BreakerThreshold, cfg.BreakerCoolDown)
+			breakers = append(breakers, b)
+			p = b
+		}
+		named[name] = p
+	}
+
+	router := NewRouter(named["default"])
+	router.breakers = breakers
+
+	for _, pair := range splitList(cfg.Routes) {
+		prefix, name, ok := strings.Cut(pair, "=")
+		prefix, name = strings.TrimSpace(prefix), strings.TrimSpace(name)
+		if !ok || prefix == "" {
+			return nil, fmt.Errorf("%w: bad route \"%s\"", ErrBadProviderConfig, pair)
+		}
+
+		p, ok := named[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown provider \"%s\"", ErrBadProviderConfig, name)
+		}
+		router.Route(prefix, p)
+	}
+
+	return router, nil
+}
+
+func newProvider(spec string) (Provider, error) {
+	switch {
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return NewClient(spec), nil
+	case strings.HasPrefix(spec, "static:"):
+		return LoadStaticProvider(strings.TrimPrefix(spec, "static:"))
+	default:
+		return nil, fmt.Errorf("%w: unknown provider \"%s\"", ErrBadProviderConfig, spec)
+	}
+}
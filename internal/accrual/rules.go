@@ -0,0 +1,235 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// rule fields and reward types
+const (
+	FieldSKU         = "sku"
+	FieldBrand       = "brand"
+	FieldDescription = "description"
+	FieldOrder       = "order"
+
+	RewardPercent = "%"
+	RewardPoints  = "pt"
+)
+
+// RulesEngine calculates accruals locally for merchants without an external
+// accrual system. Rules come from a config file and from the admin API;
+// file rules are checked first.
+type RulesEngine struct {
+	storage   storage.Service
+	fileRules []storage.AccrualRule
+}
+
+// NewRulesEngine loads the rules file, a YAML or JSON list of rules chosen
+// by extension. An empty path means there are admin API rules only.
+func NewRulesEngine(str storage.Service, rulesFile string) (*RulesEngine, error) {
+	e := &RulesEngine{storage: str}
+
+	if rulesFile == "" {
+		return e, nil
+	}
+
+	data, err := os.ReadFile(rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read accrual rules: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(rulesFile)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &e.fileRules)
+	default:
+		err = json.Unmarshal(data, &e.fileRules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse accrual rules: %w", err)
+	}
+
+	for _, r := range e.fileRules {
+		if err = validateRule(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// GetAccrual implements Provider for orders registered with AddOrder.
+func (e *RulesEngine) GetAccrual(ctx context.Context, orderNumber string) (storage.Accrual, error) {
+	order, err := e.storage.GetAccrualOrder(ctx, orderNumber)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return storage.Accrual{}, fmt.Errorf("%w: %s", ErrNotRegistered, orderNumber)
+	}
+	if err != nil {
+		return storage.Accrual{}, err
+	}
+
+	rules, err := e.Rules(ctx)
+	if err != nil {
+		return storage.Accrual{}, err
+	}
+
+	return storage.Accrual{
+		OrderNumber: orderNumber,
+		Status:      "PROCESSED",
+		Accrual:     Calculate(rules, *order),
+	}, nil
+}
+
+// AddOrder registers the order metadata for the calculation.
+func (e *RulesEngine) AddOrder(ctx context.Context, order storage.AccrualOrder) error {
+	if order.OrderNumber == "" {
+		return fmt.Errorf("%w: empty order number", ErrInvalidRule)
+	}
+
+	total := 0.0
+	for i, g := range order.Goods {
+		if g.Quantity == 0 {
+			order.Goods[i].Quantity = 1
+		}
+		if g.Price < 0 || g.Quantity < 0 {
+			return fmt.Errorf("%w: negative price or quantity", ErrInvalidRule)
+		}
+		total += g.Price * float64(order.Goods[i].Quantity)
+	}
+	if order.Total == 0 {
+		order.Total = total
+	}
+	if order.Total < 0 {
+		return fmt.Errorf("%w: negative total", ErrInvalidRule)
+	}
+
+	return e.storage.AddAccrualOrder(ctx, order)
+}
+
+// Rules returns the file rules followed by the admin API rules.
+func (e *RulesEngine) Rules(ctx context.Context) ([]storage.AccrualRule, error) {
+	stored, err := e.storage.GetAccrualRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]storage.AccrualRule, 0, len(e.fileRules)+len(stored))
+	rules = append(rules, e.fileRules...)
+	rules = append(rules, stored...)
+
+	return rules, nil
+}
+
+func (e *RulesEngine) AddRule(ctx context.Context, rule storage.AccrualRule) (uint64, error) {
+	if err := validateRule(rule); err != nil {
+		return 0, err
+	}
+
+	return e.storage.AddAccrualRule(ctx, rule)
+}
+
+func (e *RulesEngine) DeleteRule(ctx context.Context, id uint64) error {
+	deleted, err := e.storage.DeleteAccrualRule(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrRuleNotFound
+	}
+
+	return nil
+}
+
+// Calculate sums the reward of every good by the first matching goods rule
+// and the rewards of all order rules applied to the order total.
+func Calculate(rules []storage.AccrualRule, order storage.AccrualOrder) float64 {
+	result := 0.0
+
+	for _, g := range order.Goods {
+		for _, r := range rules {
+			if r.Field == FieldOrder || !matchGood(r, g) {
+				continue
+			}
+			result += reward(r, g.Price*float64(g.Quantity), g.Quantity)
+			break
+		}
+	}
+
+	for _, r := range rules {
+		if r.Field == FieldOrder {
+			result += reward(r, order.Total, 1)
+		}
+	}
+
+	return math.Round(result*100) / 100
+}
+
+func reward(r storage.AccrualRule, amount float64, units int) float64 {
+	if r.RewardType == RewardPercent {
+		return amount * r.Reward / 100
+	}
+	return r.Reward * float64(units)
+}
+
+// matchGood matches the good field against the rule glob pattern ignoring case,
+// an empty pattern matches any value
+func matchGood(r storage.AccrualRule, g storage.AccrualGood) bool {
+	var value string
+	switch r.Field {
+	case FieldSKU:
+		value = g.SKU
+	case FieldBrand:
+		value = g.Brand
+	case FieldDescription:
+		value = g.Description
+	}
+
+	if r.Match == "" {
+		return true
+	}
+
+	pattern := strings.ToLower(r.Match)
+	value = strings.ToLower(value)
+
+	if !strings.ContainsAny(pattern, "*?[") {
+		if r.Field == FieldDescription {
+			return strings.Contains(value, pattern)
+		}
+		return value == pattern
+	}
+
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
+
+func validateRule(r storage.AccrualRule) error {
+	switch r.Field {
+	case FieldSKU, FieldBrand, FieldDescription, FieldOrder:
+	default:
+		return fmt.Errorf("%w: unknown field \"%s\"", ErrInvalidRule, r.Field)
+	}
+
+	if r.RewardType != RewardPercent && r.RewardType != RewardPoints {
+		return fmt.Errorf("%w: unknown reward type \"%s\"", ErrInvalidRule, r.RewardType)
+	}
+
+	if r.Reward < 0 || (r.RewardType == RewardPercent && r.Reward > 100) {
+		return fmt.Errorf("%w: reward %v out of range", ErrInvalidRule, r.Reward)
+	}
+
+	if _, err := path.Match(strings.ToLower(r.Match), ""); err != nil {
+		return fmt.Errorf("%w: bad pattern \"%s\"", ErrInvalidRule, r.Match)
+	}
+
+	return nil
+}
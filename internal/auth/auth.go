@@ -6,34 +6,50 @@ import (
 	"crypto/hmac"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/metrics"
 	"github.com/moorzeen/loyalty-service/internal/storage"
 )
 
 const (
 	passwordHashKey    = "super secret key for user passwords hash"
 	UserAuthCookieName = "authToken"
+	// usernameConstraint is the unique constraint of USERS.USERNAME
+	usernameConstraint = "users_username_key"
 )
 
 type Credentials struct {
-	Username string `json:"login"`
-	Password string `json:"password"`
+	Username     string `json:"login"`
+	Password     string `json:"password"`
+	ReferralCode string `json:"referral_code,omitempty"` // sign up only
+}
+
+// Client is where a sign up request comes from.
+type Client struct {
+	IP     string
+	Device string // fingerprint of the client device
+}
+
+// SignUpHook runs in the transaction creating the user, its error cancels the sign up.
+type SignUpHook interface {
+	SignedUp(ctx context.Context, tx storage.Tx, userID uint64, cred Credentials, client Client) error
 }
 
 type Service struct {
 	storage storage.Service
+	hooks   []SignUpHook
 }
 
-func NewService(str storage.Service) Service {
-	return Service{storage: str}
+func NewService(str storage.Service, hooks ...SignUpHook) Service {
+	return Service{storage: str, hooks: hooks}
 }
 
-func (a *Service) SignUp(ctx context.Context, cred Credentials) error {
+func (a *Service) SignUp(ctx context.Context, cred Credentials, client Client) error {
 
 	if err := passComplexity(cred.Password); err != nil {
 		return ErrShortPassword
@@ -41,19 +57,37 @@ func (a *Service) SignUp(ctx context.Context, cred Credentials) error {
 
 	passwordHash := generateHash(cred.Password, passwordHashKey)
 
-	userID, err := a.storage.AddUser(ctx, cred.Username, passwordHash)
+	// user and account rows are created atomically, so a failure
+	// between them can't leave a user without an account
+	err := a.storage.WithTx(ctx, func(tx storage.Tx) error {
+		userID, err := tx.AddUser(ctx, cred.Username, passwordHash)
+		if err != nil {
+			return err
+		}
+
+		err = tx.AddAccount(ctx, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, h := range a.hooks {
+			err = h.SignedUp(ctx, tx, userID, cred, client)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 	var pgErr *pgconn.PgError
-	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation && pgErr.ConstraintName == usernameConstraint {
 		return ErrUsernameTaken
 	}
 	if err != nil {
 		return err
 	}
 
-	err = a.storage.AddAccount(ctx, userID)
-	if err != nil {
-		return err
-	}
+	metrics.Registrations.Inc()
 
 	return nil
 }
@@ -104,7 +138,8 @@ func (a *Service) ValidateToken(ctx context.Context, authToken string) (uint64,
 
 	_, err := fmt.Sscanf(authToken, "%d|%x", &userID, &sign)
 	if err != nil {
-		log.Printf("failed to parse authentication cookie \"%s\": %s", authToken, err.Error())
+		slog.WarnContext(ctx, "Failed to parse authentication cookie", "error", err)
+		return 0, ErrInvalidAuthToken
 	}
 
 	session, err := a.storage.GetSession(ctx, userID)
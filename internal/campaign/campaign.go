@@ -0,0 +1,122 @@
+package campaign
+
+import (
+	"context"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// campaign effects
+const (
+	EffectMultiplier = "multiplier"
+	EffectFixed      = "fixed"
+)
+
+// Service manages promo campaigns and credits their bonuses to processed orders.
+type Service struct {
+	storage storage.Service
+}
+
+func NewService(str storage.Service) Service {
+	return Service{storage: str}
+}
+
+func (s *Service) Add(ctx context.Context, c storage.Campaign) (storage.Campaign, error) {
+	if err := validateCampaign(c); err != nil {
+		return c, err
+	}
+
+	id, err := s.storage.AddCampaign(ctx, c)
+	if err != nil {
+		return c, err
+	}
+
+	c.ID = id
+	c.Awarded = 0
+	c.CreatedAt = time.Now()
+	return c, nil
+}
+
+func (s *Service) List(ctx context.Context) ([]storage.Campaign, error) {
+	return s.storage.GetCampaigns(ctx)
+}
+
+// End stops the campaign, bonuses already credited are kept.
+func (s *Service) End(ctx context.Context, id uint64) error {
+	ended, err := s.storage.EndCampaign(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ended {
+		return ErrCampaignNotFound
+	}
+
+	return nil
+}
+
+// Bonuses credits a bonus of every running campaign the user is eligible for,
+// see accrual.Bonus. Multipliers apply to the order accrual only.
+func (s *Service) Bonuses(ctx context.Context, tx storage.Tx, userID uint64, accrual storage.Accrual) ([]storage.Credit, error) {
+	campaigns, err := tx.GetActiveCampaigns(ctx, time.Now())
+	if err != nil || len(campaigns) == 0 {
+		return nil, err
+	}
+
+	stats, err := tx.GetUserStats(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tier := ""
+	for _, c := range campaigns {
+		if len(c.Tiers) > 0 {
+			tier, err = tx.GetUserTier(ctx, userID)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	var credits []storage.Credit
+	for _, c := range campaigns {
+		if !eligible(c, stats, tier) {
+			continue
+		}
+
+		amount := c.Value
+		if c.Effect == EffectMultiplier {
+			amount = round2(accrual.Accrual * (c.Value - 1))
+		}
+		if amount <= 0 {
+			continue
+		}
+
+		credits = append(credits, storage.Credit{Kind: storage.LedgerCampaign, Amount: amount, CampaignID: c.ID})
+	}
+
+	return credits, nil
+}
+
+func eligible(c storage.Campaign, stats storage.UserStats, tier string) bool {
+	if c.NewUserDays > 0 && stats.RegisteredAt.Before(time.Now().AddDate(0, 0, -c.NewUserDays)) {
+		return false
+	}
+	if stats.ProcessedOrders < c.MinOrders {
+		return false
+	}
+	if c.MaxOrders > 0 && stats.ProcessedOrders > c.MaxOrders {
+		return false
+	}
+
+	if len(c.Tiers) == 0 {
+		return true
+	}
+	for _, t := range c.Tiers {
+		if t == tier {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+package campaign
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidCampaign  = errors.New("invalid campaign")
+	ErrCampaignNotFound = errors.New("campaign not found or already ended")
+)
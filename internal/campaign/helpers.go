@@ -0,0 +1,44 @@
+package campaign
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+const maxMultiplier = 10
+
+func validateCampaign(c storage.Campaign) error {
+	switch {
+	case strings.TrimSpace(c.Name) == "":
+		return fmt.Errorf("%w: empty name", ErrInvalidCampaign)
+	case c.StartsAt.IsZero() || !c.EndsAt.After(c.StartsAt):
+		return fmt.Errorf("%w: ends_at must be after starts_at", ErrInvalidCampaign)
+	case c.NewUserDays < 0 || c.MinOrders < 0 || c.MaxOrders < 0:
+		return fmt.Errorf("%w: negative eligibility limit", ErrInvalidCampaign)
+	case c.MaxOrders > 0 && c.MaxOrders < c.MinOrders:
+		return fmt.Errorf("%w: max_orders is below min_orders", ErrInvalidCampaign)
+	}
+
+	switch c.Effect {
+	case EffectMultiplier:
+		if c.Value <= 1 || c.Value > maxMultiplier {
+			return fmt.Errorf("%w: multiplier must be above 1 and at most %d", ErrInvalidCampaign, maxMultiplier)
+		}
+	case EffectFixed:
+		if c.Value <= 0 {
+			return fmt.Errorf("%w: fixed bonus must be positive", ErrInvalidCampaign)
+		}
+	default:
+		return fmt.Errorf("%w: unknown effect \"%s\"", ErrInvalidCampaign, c.Effect)
+	}
+
+	return nil
+}
+
+// round2 rounds the sum to hundredths, the precision of the balance.
+func round2(sum float64) float64 {
+	return math.Round(sum*100) / 100
+}
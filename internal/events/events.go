@@ -0,0 +1,46 @@
+package events
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	UserRegistered     = "user.registered"
+	OrderAdded         = "order.added"
+	OrderStatusChanged = "order.status_changed"
+	BalanceAccrued     = "balance.accrued"
+	BalanceWithdrawn   = "balance.withdrawn"
+	BalanceRefunded    = "balance.refunded"
+	BalanceTransferred = "balance.transferred"
+	PointsExpired      = "points.expired"
+)
+
+type Event struct {
+	Type        string    `json:"type"`
+	UserID      uint64    `json:"-"`
+	OrderNumber string    `json:"order,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	Amount      float64   `json:"amount,omitempty"`
+	Kind        string    `json:"kind,omitempty"` // ledger kind of accrued points
+	Time        time.Time `json:"time"`
+}
+
+// Publisher delivers events to subscribers.
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Publishers fans an event out to several publishers. All of them are tried,
+// the first error is returned.
+type Publishers []Publisher
+
+func (p Publishers) Publish(ctx context.Context, e Event) error {
+	var result error
+	for _, pub := range p {
+		if err := pub.Publish(ctx, e); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
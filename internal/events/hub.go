@@ -0,0 +1,65 @@
+package events
+
+import (
+	"context"
+	"sync"
+)
+
+// subscriberBuffer is the number of events kept for a slow subscriber,
+// newer events are dropped when it is full
+const subscriberBuffer = 16
+
+// Hub is an in-process pub/sub keyed by user ID.
+type Hub struct {
+	subs  map[uint64]map[chan Event]struct{}
+	mutex *sync.RWMutex
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs:  make(map[uint64]map[chan Event]struct{}),
+		mutex: &sync.RWMutex{},
+	}
+}
+
+// Subscribe returns a channel of the user events and a function to unsubscribe.
+func (h *Hub) Subscribe(userID uint64) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	h.mutex.Lock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[chan Event]struct{})
+	}
+	h.subs[userID][ch] = struct{}{}
+	h.mutex.Unlock()
+
+	cancel := func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if _, ok := h.subs[userID][ch]; !ok {
+			return
+		}
+		delete(h.subs[userID], ch)
+		if len(h.subs[userID]) == 0 {
+			delete(h.subs, userID)
+		}
+		close(ch)
+	}
+
+	return ch, cancel
+}
+
+// Publish sends the event to the subscribers of its user without blocking.
+func (h *Hub) Publish(_ context.Context, e Event) error {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for ch := range h.subs[e.UserID] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+
+	return nil
+}
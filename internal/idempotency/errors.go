@@ -0,0 +1,11 @@
+package idempotency
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidKey = errors.New("idempotency key must be 1 to 255 characters long")
+	ErrKeyReused  = errors.New("idempotency key is already used for another request")
+	ErrInProgress = errors.New("request with the idempotency key is still in progress")
+)
@@ -0,0 +1,109 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"log/slog"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+const (
+	maxKeyLength  = 255
+	purgeInterval = time.Hour
+	// claimLease is the time a request may hold its key without a response,
+	// after it the key of a crashed request can be claimed again
+	claimLease = time.Minute
+)
+
+// Service stores the first response to a request with a client key and
+// replays it for retries with the same key until the TTL expires.
+type Service struct {
+	storage storage.Service
+	ttl     time.Duration
+	tick    *time.Ticker // Тикер для удаления истекших ключей
+}
+
+func NewService(str storage.Service, ttl time.Duration) Service {
+	s := Service{
+		storage: str,
+		ttl:     ttl,
+		tick:    time.NewTicker(purgeInterval),
+	}
+
+	go s.purge()
+
+	return s
+}
+
+// Hash identifies a request, so a key can't be reused for another one.
+func Hash(method, path, contentType string, body []byte) []byte {
+	h := sha256.New()
+	for _, part := range [][]byte{[]byte(method), []byte(path), []byte(contentType), body} {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
+// Begin claims the key for the request with hash. It returns nil when the
+// request has to be served and the stored key with the response to replay otherwise.
+func (s *Service) Begin(ctx context.Context, userID uint64, key string, hash []byte) (*storage.IdempotencyKey, error) {
+	if key == "" || len(key) > maxKeyLength {
+		return nil, ErrInvalidKey
+	}
+
+	stored, claimed, err := s.storage.ClaimIdempotencyKey(ctx, storage.IdempotencyKey{
+		UserID:      userID,
+		Key:         key,
+		RequestHash: hash,
+	}, time.Now().Add(-s.ttl), time.Now().Add(-claimLease))
+	if err != nil {
+		return nil, err
+	}
+	if claimed {
+		return nil, nil
+	}
+
+	if !bytes.Equal(stored.RequestHash, hash) {
+		return nil, ErrKeyReused
+	}
+	if stored.StatusCode == 0 {
+		return nil, ErrInProgress
+	}
+
+	return &stored, nil
+}
+
+// Complete stores the response of the claimed key.
+func (s *Service) Complete(ctx context.Context, userID uint64, key string, statusCode int, contentType string, body []byte) error {
+	return s.storage.SaveIdempotencyResponse(ctx, storage.IdempotencyKey{
+		UserID:      userID,
+		Key:         key,
+		StatusCode:  statusCode,
+		ContentType: contentType,
+		Body:        body,
+	})
+}
+
+// Release frees the claimed key, so a retry is served again.
+func (s *Service) Release(ctx context.Context, userID uint64, key string) error {
+	return s.storage.DeleteIdempotencyKey(ctx, userID, key)
+}
+
+func (s *Service) purge() {
+	for range s.tick.C {
+		ctx := context.Background()
+
+		n, err := s.storage.PurgeIdempotencyKeys(ctx, time.Now().Add(-s.ttl))
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to purge idempotency keys", "error", err)
+			continue
+		}
+		if n > 0 {
+			slog.InfoContext(ctx, "Purged expired idempotency keys", "count", n)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Redacted replaces values of sensitive attributes.
+const Redacted = "[REDACTED]"
+
+type ctxKey string
+
+const (
+	userIDKey      ctxKey = "userID"
+	orderNumberKey ctxKey = "orderNumber"
+)
+
+// sensitive lists attribute key fragments whose values are never logged.
+var sensitive = []string{"token", "cookie", "password", "secret", "signature", "authorization"}
+
+// Setup makes a JSON logger of the level ("debug", "info", "warn" or "error")
+// the default one, also for the standard log package.
+func Setup(w io.Writer, level string) error {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level \"%s\": %w", level, err)
+	}
+
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       l,
+		ReplaceAttr: redact,
+	})
+	slog.SetDefault(slog.New(contextHandler{h}))
+	log.SetFlags(0)
+
+	return nil
+}
+
+// WithUserID adds the authenticated user ID to the log lines of ctx.
+func WithUserID(ctx context.Context, userID uint64) context.Context {
+	return context.WithValue(ctx, userIDKey, userID)
+}
+
+// WithOrderNumber adds the order number to the log lines of ctx.
+func WithOrderNumber(ctx context.Context, number string) context.Context {
+	return context.WithValue(ctx, orderNumberKey, number)
+}
+
+// contextHandler adds the request ID, the user ID and the order number of
+// the context to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if id := middleware.GetReqID(ctx); id != "" {
+			r.AddAttrs(slog.String("request_id", id))
+		}
+		if id, ok := ctx.Value(userIDKey).(uint64); ok {
+			r.AddAttrs(slog.Uint64("user_id", id))
+		}
+		if n, ok := ctx.Value(orderNumberKey).(string); ok {
+			r.AddAttrs(slog.String("order_number", n))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func redact(_ []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, s := range sensitive {
+		if strings.Contains(key, s) {
+			return slog.String(a.Key, Redacted)
+		}
+	}
+	return a
+}
+
+// Middleware logs every request after it is served, replacing chi's access log.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, "request served",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
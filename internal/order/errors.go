@@ -9,4 +9,24 @@ var (
 	ErrAddedByOther       = errors.New("already added by other")
 	ErrInvalidOrderNumber = errors.New("invalid order number")
 	ErrInsufficientFunds  = errors.New("insufficient funds")
+	ErrEmptyBatch         = errors.New("no order numbers in the batch")
+	ErrBatchTooLarge      = errors.New("too many order numbers in the batch")
+	ErrOrderNotFound      = errors.New("order not found")
+	ErrInvalidCursor      = errors.New("invalid page cursor")
+	ErrInvalidFilter      = errors.New("invalid history filter")
+	ErrWithdrawalNotFound = errors.New("withdrawal not found")
+	ErrInvalidReversal    = errors.New("reversal sum must be positive")
+	ErrReversalTooLarge   = errors.New("reversal exceeds the withdrawal remainder")
+	ErrAlreadyReversed    = errors.New("withdrawal is already fully reversed")
+	ErrRecipientNotFound  = errors.New("transfer recipient not found")
+	ErrSelfTransfer       = errors.New("can't transfer points to yourself")
+	ErrTransferLimit      = errors.New("daily transfer limit exceeded")
+	ErrInvalidLimits      = errors.New("transfer limits must not be negative")
+	ErrAlreadyWithdrawn   = errors.New("order is already paid with points")
+	ErrInvalidSum         = errors.New("sum must be positive")
+	ErrInvalidHoldTTL     = errors.New("hold TTL is out of range")
+	ErrHoldNotFound       = errors.New("hold not found")
+	ErrHoldNotActive      = errors.New("hold is already settled")
+	ErrHoldExpired        = errors.New("hold is expired")
+	ErrCaptureTooLarge    = errors.New("capture exceeds the hold")
 )
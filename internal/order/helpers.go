@@ -1,7 +1,16 @@
 package order
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/moorzeen/loyalty-service/internal/storage"
 )
 
 func parseOrderNumber(s string) error {
@@ -31,3 +40,97 @@ func parseOrderNumber(s string) error {
 
 	return nil
 }
+
+// encodeCursor makes an opaque page cursor from the last row of a page.
+func encodeCursor(t time.Time, orderNumber string) string {
+	raw := fmt.Sprintf("%d|%s", t.UnixMicro(), orderNumber)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (*storage.Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	micro, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &storage.Cursor{Time: time.UnixMicro(micro), OrderNumber: parts[1]}, nil
+}
+
+// historyQuery validates the options and converts them to a storage query
+// which requests one extra row to find out whether there is a next page.
+func historyQuery(opts HistoryOptions) (storage.HistoryQuery, int, error) {
+	after, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return storage.HistoryQuery{}, 0, err
+	}
+
+	for _, st := range opts.Statuses {
+		if !isOrderStatus(st) {
+			return storage.HistoryQuery{}, 0, fmt.Errorf("%w: unknown status \"%s\"", ErrInvalidFilter, st)
+		}
+	}
+
+	if !opts.From.IsZero() && !opts.To.IsZero() && !opts.From.Before(opts.To) {
+		return storage.HistoryQuery{}, 0, fmt.Errorf("%w: \"from\" must be before \"to\"", ErrInvalidFilter)
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+
+	hq := storage.HistoryQuery{
+		Statuses: opts.Statuses,
+		From:     opts.From,
+		To:       opts.To,
+		Desc:     opts.Desc,
+		After:    after,
+		Limit:    limit + 1,
+	}
+
+	return hq, limit, nil
+}
+
+func isOrderStatus(s string) bool {
+	switch s {
+	case StatusNew, StatusRegistered, StatusProcessing, StatusInvalid, StatusProcessed:
+		return true
+	default:
+		return false
+	}
+}
+
+func batchResult(err error) string {
+	switch {
+	case err == nil:
+		return ResultAccepted
+	case errors.Is(err, ErrAlreadyAddByThis):
+		return ResultDuplicateOwn
+	case errors.Is(err, ErrAddedByOther):
+		return ResultDuplicateOther
+	default:
+		return ResultInvalid
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation
+}
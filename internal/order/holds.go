@@ -0,0 +1,122 @@
+package order
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/metrics"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// hold statuses
+const (
+	HoldActive   = "ACTIVE"
+	HoldCaptured = "CAPTURED"
+	HoldReleased = "RELEASED"
+	HoldExpired  = "EXPIRED"
+)
+
+const (
+	MaxHoldTTL         = 24 * time.Hour
+	holdExpiryInterval = time.Minute
+)
+
+// HoldRequest reserves Sum points for the purchase OrderNumber. TTL is in
+// seconds, zero means the service default.
+type HoldRequest struct {
+	UserID      uint64
+	OrderNumber string  `json:"order"`
+	Sum         float64 `json:"sum"`
+	TTL         int     `json:"ttl,omitempty"`
+}
+
+// AddHold reserves points of the available balance until the hold is
+// captured, released or expired.
+func (o *Service) AddHold(ctx context.Context, request HoldRequest) (storage.Hold, error) {
+	if err := parseOrderNumber(request.OrderNumber); err != nil {
+		return storage.Hold{}, ErrInvalidOrderNumber
+	}
+	if request.Sum <= 0 {
+		return storage.Hold{}, ErrInvalidSum
+	}
+
+	ttl := o.holdTTL
+	if request.TTL != 0 {
+		ttl = time.Duration(request.TTL) * time.Second
+	}
+	if ttl <= 0 || ttl > MaxHoldTTL {
+		return storage.Hold{}, ErrInvalidHoldTTL
+	}
+
+	hold, err := o.storage.AddHold(ctx, storage.Hold{
+		UserID:      request.UserID,
+		OrderNumber: request.OrderNumber,
+		Sum:         request.Sum,
+		ExpiresAt:   time.Now().Add(ttl),
+	})
+	if isUniqueViolation(err) {
+		return hold, ErrAlreadyWithdrawn
+	}
+
+	return hold, err
+}
+
+func (o *Service) GetHold(ctx context.Context, userID uint64, id uint64) (storage.Hold, error) {
+	return o.storage.GetHold(ctx, userID, id)
+}
+
+// CaptureHold withdraws sum of the hold, all of it when sum is zero.
+// The rest of a partially captured hold returns to the available balance.
+func (o *Service) CaptureHold(ctx context.Context, userID uint64, id uint64, sum float64) (storage.Hold, error) {
+	if sum < 0 {
+		return storage.Hold{}, ErrInvalidSum
+	}
+
+	hold, err := o.storage.CaptureHold(ctx, userID, id, sum)
+	if isUniqueViolation(err) {
+		return hold, ErrAlreadyWithdrawn
+	}
+	if err != nil {
+		return hold, err
+	}
+
+	metrics.PointsWithdrawn.Add(hold.Captured)
+
+	if o.events != nil {
+		e := events.Event{
+			Type:        events.BalanceWithdrawn,
+			UserID:      userID,
+			OrderNumber: hold.OrderNumber,
+			Amount:      hold.Captured,
+			Time:        time.Now(),
+		}
+		if err = o.events.Publish(ctx, e); err != nil {
+			slog.ErrorContext(ctx, "Failed to publish withdrawal", "error", err)
+		}
+	}
+
+	return hold, nil
+}
+
+func (o *Service) ReleaseHold(ctx context.Context, userID uint64, id uint64) (storage.Hold, error) {
+	return o.storage.ReleaseHold(ctx, userID, id)
+}
+
+// expireHolds settles the holds past their expiry. The balance doesn't
+// depend on it: expired holds stop reserving points right away.
+func (o *Service) expireHolds() {
+	for range o.tick.C {
+		ctx := context.Background()
+
+		holds, err := o.storage.ExpireHolds(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to expire holds", "error", err)
+			continue
+		}
+		if len(holds) > 0 {
+			slog.InfoContext(ctx, "Expired holds", "count", len(holds))
+		}
+	}
+}
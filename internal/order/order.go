@@ -3,15 +3,47 @@ package order
 import (
 	"context"
 	"errors"
+	"log/slog"
 	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/metrics"
+	"github.com/moorzeen/loyalty-service/internal/points"
 	"github.com/moorzeen/loyalty-service/internal/storage"
 )
 
+const (
+	StatusNew        = "NEW"
+	StatusRegistered = "REGISTERED"
+	StatusProcessing = "PROCESSING"
+	StatusInvalid    = "INVALID"
+	StatusProcessed  = "PROCESSED"
+)
+
+const (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+	MaxBatchSize     = 1000
+	maxExpirations   = 12 // upcoming expirations in the balance
+)
+
+// batch upload results
+const (
+	ResultAccepted       = "accepted"
+	ResultDuplicateOwn   = "duplicate-own"
+	ResultDuplicateOther = "duplicate-other"
+	ResultInvalid        = "invalid"
+)
+
 type Service struct {
 	storage storage.Service
+	events  events.Publisher
+	holdTTL time.Duration
+	expiry  points.Policy
+	tick    *time.Ticker // Тикер для проверки истекших удержаний
 }
 
 type Order struct {
@@ -21,9 +53,28 @@ type Order struct {
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
+type BatchResult struct {
+	Number string `json:"number"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Details struct {
+	Order
+	History []Event `json:"history"`
+}
+
+type Event struct {
+	Status    string    `json:"status"`
+	Accrual   float64   `json:"accrual,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
 type Balance struct {
-	Balance   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Balance   float64              `json:"current"`
+	Withdrawn float64              `json:"withdrawn"`
+	Held      float64              `json:"held,omitempty"`
+	Expiring  []storage.Expiration `json:"expiring,omitempty"`
 }
 
 type Withdraw struct {
@@ -32,8 +83,43 @@ type Withdraw struct {
 	WithdrawSum float64 `json:"sum"`
 }
 
-func NewService(str storage.Service) Service {
-	return Service{storage: str}
+// Reversal returns points of a withdrawal, all of the remainder when Sum is zero.
+type Reversal struct {
+	OrderNumber string  `json:"-"`
+	Sum         float64 `json:"sum"`
+	Reason      string  `json:"reason"`
+}
+
+// withdrawal reversal statuses
+const (
+	ReversalNone    = "NONE"
+	ReversalPartial = "PARTIAL"
+	ReversalFull    = "FULL"
+)
+
+// HistoryOptions filters and pages the order and withdrawal history.
+type HistoryOptions struct {
+	Statuses []string // orders only
+	From     time.Time
+	To       time.Time
+	Desc     bool
+	Cursor   string
+	Limit    int
+}
+
+// NewService starts expiring holds, which are kept for holdTTL by default.
+func NewService(str storage.Service, pub events.Publisher, holdTTL time.Duration, expiry points.Policy) Service {
+	o := Service{
+		storage: str,
+		events:  pub,
+		holdTTL: holdTTL,
+		expiry:  expiry,
+		tick:    time.NewTicker(holdExpiryInterval),
+	}
+
+	go o.expireHolds()
+
+	return o
 }
 
 func (o *Service) AddOrder(ctx context.Context, orderNumber string, userID uint64) error {
@@ -62,22 +148,120 @@ func (o *Service) AddOrder(ctx context.Context, orderNumber string, userID uint6
 	return nil
 }
 
-func (o *Service) GetOrders(ctx context.Context, userID uint64) ([]storage.Order, error) {
-	orders, err := o.storage.GetOrders(ctx, userID)
+// AddOrders adds a batch of order numbers in one storage round trip and
+// reports the outcome for each number in the input order.
+func (o *Service) AddOrders(ctx context.Context, orderNumbers []string, userID uint64) ([]BatchResult, error) {
+	if len(orderNumbers) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	if len(orderNumbers) > MaxBatchSize {
+		return nil, ErrBatchTooLarge
+	}
+
+	errs := make(map[string]error, len(orderNumbers))
+	valid := make([]string, 0, len(orderNumbers))
+
+	for _, n := range orderNumbers {
+		if _, ok := errs[n]; ok {
+			continue
+		}
+		if n == "" || parseOrderNumber(n) != nil {
+			errs[n] = ErrInvalidOrderNumber
+			continue
+		}
+		errs[n] = nil
+		valid = append(valid, n)
+	}
+
+	if len(valid) > 0 {
+		added, err := o.storage.AddOrders(ctx, valid, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range added {
+			switch {
+			case v.Added:
+				errs[v.OrderNumber] = nil
+			case v.UserID == userID:
+				errs[v.OrderNumber] = ErrAlreadyAddByThis
+			default:
+				errs[v.OrderNumber] = ErrAddedByOther
+			}
+		}
+	}
+
+	result := make([]BatchResult, 0, len(orderNumbers))
+	for _, n := range orderNumbers {
+		err := errs[n]
+		item := BatchResult{Number: n, Result: batchResult(err)}
+		if err != nil {
+			item.Error = err.Error()
+		}
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+// GetOrder returns the user order with its status history. Orders of other
+// users are reported as not found.
+func (o *Service) GetOrder(ctx context.Context, orderNumber string, userID uint64) (*storage.Order, []storage.OrderEvent, error) {
+	order, err := o.storage.GetOrder(ctx, orderNumber)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, ErrOrderNotFound
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if order.UserID != userID {
+		return nil, nil, ErrOrderNotFound
 	}
 
-	return orders, nil
+	events, err := o.storage.GetOrderEvents(ctx, orderNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return order, events, nil
+}
+
+// GetOrders returns a page of user orders and the cursor of the next page,
+// which is empty on the last page.
+func (o *Service) GetOrders(ctx context.Context, userID uint64, opts HistoryOptions) ([]storage.Order, string, error) {
+	hq, limit, err := historyQuery(opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	orders, err := o.storage.GetOrders(ctx, userID, hq)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(orders) > limit {
+		orders = orders[:limit]
+		last := orders[limit-1]
+		next = encodeCursor(last.UploadedAt, last.OrderNumber)
+	}
+
+	return orders, next, nil
 }
 
-func (o *Service) GetBalance(ctx context.Context, userID uint64) (float64, float64, error) {
-	bal, wtn, err := o.storage.GetBalance(ctx, userID)
+func (o *Service) GetBalance(ctx context.Context, userID uint64) (Balance, error) {
+	bal, err := o.storage.GetBalance(ctx, userID)
+	if err != nil {
+		return Balance{}, err
+	}
+
+	expiring, err := o.storage.GetExpirations(ctx, userID, maxExpirations)
 	if err != nil {
-		return 0, 0, err
+		return Balance{}, err
 	}
 
-	return bal, wtn, nil
+	return Balance{Balance: bal.Current, Withdrawn: bal.Withdrawn, Held: bal.Held, Expiring: expiring}, nil
 }
 
 func (o *Service) Withdraw(ctx context.Context, request Withdraw) error {
@@ -86,17 +270,92 @@ func (o *Service) Withdraw(ctx context.Context, request Withdraw) error {
 	}
 
 	err := o.storage.Withdraw(ctx, request.UserID, request.OrderNumber, request.WithdrawSum)
+	if isUniqueViolation(err) {
+		return ErrAlreadyWithdrawn
+	}
 	if err != nil {
 		return err
 	}
 
+	metrics.PointsWithdrawn.Add(request.WithdrawSum)
+
+	if o.events != nil {
+		e := events.Event{
+			Type:        events.BalanceWithdrawn,
+			UserID:      request.UserID,
+			OrderNumber: request.OrderNumber,
+			Amount:      request.WithdrawSum,
+			Time:        time.Now(),
+		}
+		if err = o.events.Publish(ctx, e); err != nil {
+			slog.ErrorContext(ctx, "Failed to publish withdrawal", "error", err)
+		}
+	}
+
 	return nil
 }
 
-func (o *Service) GetWithdrawals(ctx context.Context, userID uint64) ([]storage.Withdrawal, error) {
-	withdrawals, err := o.storage.GetWithdrawals(ctx, userID)
+// ReverseWithdrawal returns points of a cancelled purchase to the balance.
+func (o *Service) ReverseWithdrawal(ctx context.Context, request Reversal) (storage.WithdrawalReversal, error) {
+	if request.Sum < 0 {
+		return storage.WithdrawalReversal{}, ErrInvalidReversal
+	}
+
+	rev, err := o.storage.ReverseWithdrawal(ctx, request.OrderNumber, request.Sum, request.Reason, o.expiry.ExpiresAt(time.Now()))
 	if err != nil {
-		return nil, err
+		return rev, err
+	}
+
+	metrics.PointsRefunded.Add(rev.Sum)
+
+	if o.events != nil {
+		e := events.Event{
+			Type:        events.BalanceRefunded,
+			UserID:      rev.UserID,
+			OrderNumber: rev.OrderNumber,
+			Amount:      rev.Sum,
+			Time:        rev.CreatedAt,
+		}
+		if err = o.events.Publish(ctx, e); err != nil {
+			slog.ErrorContext(ctx, "Failed to publish withdrawal reversal", "error", err)
+		}
+	}
+
+	return rev, nil
+}
+
+// ReversalStatus tells whether the withdrawal is returned in part or in full.
+func ReversalStatus(w storage.Withdrawal) string {
+	switch {
+	case w.Reversed <= 0:
+		return ReversalNone
+	case w.Reversed < w.Sum:
+		return ReversalPartial
+	default:
+		return ReversalFull
 	}
-	return withdrawals, nil
+}
+
+// GetWithdrawals returns a page of user withdrawals and the cursor of the next page,
+// which is empty on the last page.
+func (o *Service) GetWithdrawals(ctx context.Context, userID uint64, opts HistoryOptions) ([]storage.Withdrawal, string, error) {
+	opts.Statuses = nil
+	hq, limit, err := historyQuery(opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	withdrawals, err := o.storage.GetWithdrawals(ctx, userID, hq)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(withdrawals) > limit {
+		withdrawals = withdrawals[:limit]
+		last := withdrawals[limit-1]
+		next = encodeCursor(last.ProcessedAt, last.OrderNumber)
+	}
+
+	return withdrawals, next, nil
 }
@@ -0,0 +1,375 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+const (
+	testOrder  = "12345678903"
+	otherOrder = "79927398713"
+)
+
+var errUnique = &pgconn.PgError{Code: pgerrcode.UniqueViolation}
+
+// fundsStorage keeps the balance of user 1 in memory the way the
+// postgres storage does.
+type fundsStorage struct {
+	storage.Service
+	balance     float64
+	withdrawals map[string]float64
+	reversed    map[string]float64
+	holds       map[uint64]storage.Hold
+	calls       int
+}
+
+func newFundsStorage(balance float64) *fundsStorage {
+	return &fundsStorage{
+		balance:     balance,
+		withdrawals: map[string]float64{},
+		reversed:    map[string]float64{},
+		holds:       map[uint64]storage.Hold{},
+	}
+}
+
+func (s *fundsStorage) held() float64 {
+	var sum float64
+	for _, h := range s.holds {
+		if h.Status == HoldActive {
+			sum += h.Sum
+		}
+	}
+	return sum
+}
+
+func (s *fundsStorage) Withdraw(_ context.Context, _ uint64, number string, sum float64) error {
+	s.calls++
+	if _, ok := s.withdrawals[number]; ok {
+		return errUnique
+	}
+	if sum > s.balance-s.held() {
+		return ErrInsufficientFunds
+	}
+	s.withdrawals[number] = sum
+	s.balance -= sum
+	return nil
+}
+
+func (s *fundsStorage) AddHold(_ context.Context, hold storage.Hold) (storage.Hold, error) {
+	s.calls++
+	for _, h := range s.holds {
+		if h.OrderNumber == hold.OrderNumber {
+			return hold, errUnique
+		}
+	}
+	if hold.Sum > s.balance-s.held() {
+		return hold, ErrInsufficientFunds
+	}
+	hold.ID = uint64(len(s.holds) + 1)
+	hold.Status = HoldActive
+	s.holds[hold.ID] = hold
+	return hold, nil
+}
+
+func (s *fundsStorage) CaptureHold(_ context.Context, _ uint64, id uint64, sum float64) (storage.Hold, error) {
+	s.calls++
+	hold, ok := s.holds[id]
+	switch {
+	case !ok:
+		return hold, ErrHoldNotFound
+	case hold.Status != HoldActive:
+		return hold, ErrHoldNotActive
+	case sum > hold.Sum:
+		return hold, ErrCaptureTooLarge
+	}
+	if _, ok = s.withdrawals[hold.OrderNumber]; ok {
+		return hold, errUnique
+	}
+	if sum == 0 {
+		sum = hold.Sum
+	}
+
+	hold.Status, hold.Captured = HoldCaptured, sum
+	s.holds[id] = hold
+	s.withdrawals[hold.OrderNumber] = sum
+	s.balance -= sum
+	return hold, nil
+}
+
+func (s *fundsStorage) ReleaseHold(_ context.Context, _ uint64, id uint64) (storage.Hold, error) {
+	s.calls++
+	hold, ok := s.holds[id]
+	if !ok || hold.Status != HoldActive {
+		return hold, ErrHoldNotActive
+	}
+	hold.Status = HoldReleased
+	s.holds[id] = hold
+	return hold, nil
+}
+
+func (s *fundsStorage) ReverseWithdrawal(_ context.Context, number string, sum float64, reason string, _ time.Time) (storage.WithdrawalReversal, error) {
+	s.calls++
+	rev := storage.WithdrawalReversal{UserID: 1, OrderNumber: number, Reason: reason}
+	withdrawn, ok := s.withdrawals[number]
+	if !ok {
+		return rev, ErrWithdrawalNotFound
+	}
+
+	remainder := withdrawn - s.reversed[number]
+	switch {
+	case remainder <= 0:
+		return rev, ErrAlreadyReversed
+	case sum == 0:
+		sum = remainder
+	case sum > remainder:
+		return rev, ErrReversalTooLarge
+	}
+
+	s.reversed[number] += sum
+	s.balance += sum
+	rev.Sum = sum
+	return rev, nil
+}
+
+func (s *fundsStorage) Transfer(_ context.Context, _ uint64, recipient string, sum float64) (storage.Transfer, error) {
+	s.calls++
+	t := storage.Transfer{ID: 1, Direction: TransferOut, Counterparty: recipient, Sum: sum}
+	switch {
+	case recipient == "user":
+		return t, ErrSelfTransfer
+	case recipient != "friend":
+		return t, ErrRecipientNotFound
+	case sum > s.balance-s.held():
+		return t, ErrInsufficientFunds
+	}
+	t.CounterpartyID = 2
+	s.balance -= sum
+	return t, nil
+}
+
+type recorder struct {
+	events []events.Event
+}
+
+func (r *recorder) Publish(_ context.Context, e events.Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func newTestService(str storage.Service) (Service, *recorder) {
+	pub := &recorder{}
+	return Service{storage: str, events: pub, holdTTL: time.Minute}, pub
+}
+
+func TestWithdraw(t *testing.T) {
+	ctx := context.Background()
+	str := newFundsStorage(100)
+	s, pub := newTestService(str)
+
+	err := s.Withdraw(ctx, Withdraw{UserID: 1, OrderNumber: "12345678900", WithdrawSum: 10})
+	if !errors.Is(err, ErrInvalidOrderNumber) || str.calls != 0 {
+		t.Errorf("invalid order: got %v after %d storage calls", err, str.calls)
+	}
+
+	err = s.Withdraw(ctx, Withdraw{UserID: 1, OrderNumber: testOrder, WithdrawSum: 150})
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("overdraft: got %v, want ErrInsufficientFunds", err)
+	}
+
+	err = s.Withdraw(ctx, Withdraw{UserID: 1, OrderNumber: testOrder, WithdrawSum: 40})
+	if err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+	if str.balance != 60 {
+		t.Errorf("got balance %v, want 60", str.balance)
+	}
+	if len(pub.events) != 1 || pub.events[0].Type != events.BalanceWithdrawn || pub.events[0].Amount != 40 {
+		t.Errorf("got events %+v, want one withdrawal of 40", pub.events)
+	}
+
+	err = s.Withdraw(ctx, Withdraw{UserID: 1, OrderNumber: testOrder, WithdrawSum: 10})
+	if !errors.Is(err, ErrAlreadyWithdrawn) {
+		t.Errorf("repeated withdrawal: got %v, want ErrAlreadyWithdrawn", err)
+	}
+}
+
+func TestHolds(t *testing.T) {
+	ctx := context.Background()
+	str := newFundsStorage(100)
+	s, pub := newTestService(str)
+
+	for _, tt := range []struct {
+		request HoldRequest
+		err     error
+	}{
+		{HoldRequest{UserID: 1, OrderNumber: testOrder, Sum: 0}, ErrInvalidSum},
+		{HoldRequest{UserID: 1, OrderNumber: testOrder, Sum: 10, TTL: -1}, ErrInvalidHoldTTL},
+		{HoldRequest{UserID: 1, OrderNumber: testOrder, Sum: 10, TTL: int(MaxHoldTTL.Seconds()) + 1}, ErrInvalidHoldTTL},
+		{HoldRequest{UserID: 1, OrderNumber: "1", Sum: 10}, ErrInvalidOrderNumber},
+	} {
+		if _, err := s.AddHold(ctx, tt.request); !errors.Is(err, tt.err) {
+			t.Errorf("hold %+v: got %v, want %v", tt.request, err, tt.err)
+		}
+	}
+	if str.calls != 0 {
+		t.Errorf("invalid holds made %d storage calls", str.calls)
+	}
+
+	hold, err := s.AddHold(ctx, HoldRequest{UserID: 1, OrderNumber: testOrder, Sum: 70})
+	if err != nil {
+		t.Fatalf("hold: %v", err)
+	}
+	if time.Until(hold.ExpiresAt) > time.Minute {
+		t.Errorf("hold expires at %s, want the default TTL", hold.ExpiresAt)
+	}
+
+	// held points are not available
+	err = s.Withdraw(ctx, Withdraw{UserID: 1, OrderNumber: otherOrder, WithdrawSum: 40})
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("withdrawal of held points: got %v, want ErrInsufficientFunds", err)
+	}
+	if _, err = s.AddHold(ctx, HoldRequest{UserID: 1, OrderNumber: testOrder, Sum: 10}); !errors.Is(err, ErrAlreadyWithdrawn) {
+		t.Errorf("second hold of the order: got %v, want ErrAlreadyWithdrawn", err)
+	}
+
+	if _, err = s.CaptureHold(ctx, 1, hold.ID, -1); !errors.Is(err, ErrInvalidSum) {
+		t.Errorf("negative capture: got %v, want ErrInvalidSum", err)
+	}
+	if _, err = s.CaptureHold(ctx, 1, hold.ID, 80); !errors.Is(err, ErrCaptureTooLarge) {
+		t.Errorf("capture over the hold: got %v, want ErrCaptureTooLarge", err)
+	}
+
+	// the rest of a partial capture returns to the available balance
+	captured, err := s.CaptureHold(ctx, 1, hold.ID, 50)
+	if err != nil {
+		t.Fatalf("capture: %v", err)
+	}
+	if captured.Status != HoldCaptured || str.balance != 50 || str.held() != 0 {
+		t.Errorf("got %s hold, balance %v, held %v; want captured, 50, 0", captured.Status, str.balance, str.held())
+	}
+	if n := len(pub.events); n != 1 || pub.events[0].Amount != 50 {
+		t.Errorf("got events %+v, want one withdrawal of 50", pub.events)
+	}
+
+	if _, err = s.CaptureHold(ctx, 1, hold.ID, 0); !errors.Is(err, ErrHoldNotActive) {
+		t.Errorf("second capture: got %v, want ErrHoldNotActive", err)
+	}
+}
+
+func TestReleaseHold(t *testing.T) {
+	ctx := context.Background()
+	str := newFundsStorage(100)
+	s, _ := newTestService(str)
+
+	hold, err := s.AddHold(ctx, HoldRequest{UserID: 1, OrderNumber: testOrder, Sum: 100})
+	if err != nil {
+		t.Fatalf("hold: %v", err)
+	}
+	if _, err = s.ReleaseHold(ctx, 1, hold.ID); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	if err = s.Withdraw(ctx, Withdraw{UserID: 1, OrderNumber: otherOrder, WithdrawSum: 100}); err != nil {
+		t.Errorf("withdrawal of released points: %v", err)
+	}
+}
+
+func TestReverseWithdrawal(t *testing.T) {
+	ctx := context.Background()
+	str := newFundsStorage(100)
+	s, pub := newTestService(str)
+
+	if err := s.Withdraw(ctx, Withdraw{UserID: 1, OrderNumber: testOrder, WithdrawSum: 40}); err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+
+	if _, err := s.ReverseWithdrawal(ctx, Reversal{OrderNumber: testOrder, Sum: -1}); !errors.Is(err, ErrInvalidReversal) {
+		t.Errorf("negative reversal: got %v, want ErrInvalidReversal", err)
+	}
+	if _, err := s.ReverseWithdrawal(ctx, Reversal{OrderNumber: testOrder, Sum: 50}); !errors.Is(err, ErrReversalTooLarge) {
+		t.Errorf("reversal over the withdrawal: got %v, want ErrReversalTooLarge", err)
+	}
+
+	rev, err := s.ReverseWithdrawal(ctx, Reversal{OrderNumber: testOrder, Sum: 15, Reason: "returned"})
+	if err != nil || rev.Sum != 15 {
+		t.Fatalf("partial reversal: got %+v, %v", rev, err)
+	}
+
+	// zero sum reverses the remainder
+	rev, err = s.ReverseWithdrawal(ctx, Reversal{OrderNumber: testOrder})
+	if err != nil || rev.Sum != 25 {
+		t.Fatalf("full reversal: got %+v, %v", rev, err)
+	}
+	if str.balance != 100 {
+		t.Errorf("got balance %v, want 100", str.balance)
+	}
+
+	if _, err = s.ReverseWithdrawal(ctx, Reversal{OrderNumber: testOrder}); !errors.Is(err, ErrAlreadyReversed) {
+		t.Errorf("repeated reversal: got %v, want ErrAlreadyReversed", err)
+	}
+
+	var refunded float64
+	for _, e := range pub.events {
+		if e.Type == events.BalanceRefunded {
+			refunded += e.Amount
+		}
+	}
+	if refunded != 40 {
+		t.Errorf("got %v refunded in events, want 40", refunded)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	ctx := context.Background()
+	str := newFundsStorage(100)
+	s, pub := newTestService(str)
+
+	for _, tt := range []struct {
+		request TransferRequest
+		err     error
+	}{
+		{TransferRequest{UserID: 1, Recipient: " ", Sum: 10}, ErrRecipientNotFound},
+		{TransferRequest{UserID: 1, Recipient: "friend", Sum: 0}, ErrInvalidSum},
+		{TransferRequest{UserID: 1, Recipient: "friend", Sum: -5}, ErrInvalidSum},
+	} {
+		if _, err := s.Transfer(ctx, tt.request); !errors.Is(err, tt.err) {
+			t.Errorf("transfer %+v: got %v, want %v", tt.request, err, tt.err)
+		}
+	}
+	if str.calls != 0 {
+		t.Errorf("invalid transfers made %d storage calls", str.calls)
+	}
+
+	if _, err := s.Transfer(ctx, TransferRequest{UserID: 1, Recipient: "user", Sum: 10}); !errors.Is(err, ErrSelfTransfer) {
+		t.Errorf("self transfer: got %v, want ErrSelfTransfer", err)
+	}
+	if _, err := s.Transfer(ctx, TransferRequest{UserID: 1, Recipient: "friend", Sum: 150}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("overdraft: got %v, want ErrInsufficientFunds", err)
+	}
+	if len(pub.events) != 0 {
+		t.Errorf("failed transfers published %+v", pub.events)
+	}
+
+	tr, err := s.Transfer(ctx, TransferRequest{UserID: 1, Recipient: " friend ", Sum: 30})
+	if err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if tr.Counterparty != "friend" || str.balance != 70 {
+		t.Errorf("got transfer to %q and balance %v, want friend and 70", tr.Counterparty, str.balance)
+	}
+
+	if len(pub.events) != 2 {
+		t.Fatalf("got events %+v, want both sides", pub.events)
+	}
+	out, in := pub.events[0], pub.events[1]
+	if out.UserID != 1 || out.Status != TransferOut || in.UserID != 2 || in.Status != TransferIn || out.Amount != 30 || in.Amount != 30 {
+		t.Errorf("got events %+v and %+v", out, in)
+	}
+}
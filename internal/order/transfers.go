@@ -0,0 +1,93 @@
+package order
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/metrics"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// transfer directions
+const (
+	TransferIn  = "IN"
+	TransferOut = "OUT"
+)
+
+// TransferRequest moves Sum points of the user to the Recipient login.
+type TransferRequest struct {
+	UserID    uint64
+	Recipient string  `json:"login"`
+	Sum       float64 `json:"sum"`
+}
+
+// Transfer moves points between users atomically. The recipient gets them
+// with the expiry they had at the sender.
+func (o *Service) Transfer(ctx context.Context, request TransferRequest) (storage.Transfer, error) {
+	recipient := strings.TrimSpace(request.Recipient)
+	if recipient == "" {
+		return storage.Transfer{}, ErrRecipientNotFound
+	}
+	if request.Sum <= 0 {
+		return storage.Transfer{}, ErrInvalidSum
+	}
+
+	t, err := o.storage.Transfer(ctx, request.UserID, recipient, request.Sum)
+	if err != nil {
+		return t, err
+	}
+
+	metrics.PointsTransferred.Add(t.Sum)
+
+	if o.events != nil {
+		for _, e := range []events.Event{
+			{Type: events.BalanceTransferred, UserID: request.UserID, Status: TransferOut, Amount: t.Sum, Time: t.CreatedAt},
+			{Type: events.BalanceTransferred, UserID: t.CounterpartyID, Status: TransferIn, Amount: t.Sum, Time: t.CreatedAt},
+		} {
+			if err = o.events.Publish(ctx, e); err != nil {
+				slog.ErrorContext(ctx, "Failed to publish transfer", "error", err)
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// GetTransfers returns a page of the transfers sent and received by the user
+// and the cursor of the next page, which is empty on the last page.
+func (o *Service) GetTransfers(ctx context.Context, userID uint64, opts HistoryOptions) ([]storage.Transfer, string, error) {
+	opts.Statuses = nil
+	hq, limit, err := historyQuery(opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	transfers, err := o.storage.GetTransfers(ctx, userID, hq)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(transfers) > limit {
+		transfers = transfers[:limit]
+		last := transfers[limit-1]
+		next = encodeCursor(last.CreatedAt, storage.TransferKey(last.ID))
+	}
+
+	return transfers, next, nil
+}
+
+func (o *Service) GetTransferLimits(ctx context.Context) (storage.TransferLimits, error) {
+	return o.storage.GetTransferLimits(ctx)
+}
+
+// SetTransferLimits sets the daily limits of every sender, zero removes a limit.
+func (o *Service) SetTransferLimits(ctx context.Context, limits storage.TransferLimits) (storage.TransferLimits, error) {
+	if limits.DailySum < 0 || limits.DailyCount < 0 {
+		return limits, ErrInvalidLimits
+	}
+
+	return o.storage.SetTransferLimits(ctx, limits)
+}
@@ -0,0 +1,142 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// Broker is the minimal message broker client used by BrokerPublisher.
+// Its shape fits both NATS (subject) and Kafka (topic, key) producers.
+type Broker interface {
+	Send(ctx context.Context, topic string, key string, value []byte) error
+	// Flush returns when all sent messages are accepted by the broker.
+	Flush(ctx context.Context) error
+	Close() error
+}
+
+// BrokerPublisher publishes every message to the "<prefix>.<type>" topic
+// keyed by the message ID.
+type BrokerPublisher struct {
+	broker Broker
+	prefix string
+}
+
+func NewBrokerPublisher(b Broker, prefix string) *BrokerPublisher {
+	return &BrokerPublisher{broker: b, prefix: prefix}
+}
+
+func (p *BrokerPublisher) Publish(ctx context.Context, msgs []storage.OutboxMessage) error {
+	for _, m := range msgs {
+		value, err := json.Marshal(toMessage(m))
+		if err != nil {
+			return err
+		}
+
+		topic := m.Type
+		if p.prefix != "" {
+			topic = p.prefix + "." + m.Type
+		}
+
+		err = p.broker.Send(ctx, topic, strconv.FormatUint(m.ID, 10), value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.broker.Flush(ctx)
+}
+
+func (p *BrokerPublisher) Close() error {
+	return p.broker.Close()
+}
+
+// BrokerMessage is a message kept by MemoryBroker.
+type BrokerMessage struct {
+	Topic string
+	Key   string
+	Value []byte
+}
+
+// MemoryBroker is an in-process broker for tests. Subscribers get messages
+// of the topics starting with their prefix.
+type MemoryBroker struct {
+	messages []BrokerMessage
+	subs     map[chan BrokerMessage]string
+	closed   bool
+	mutex    *sync.Mutex
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subs:  make(map[chan BrokerMessage]string),
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (b *MemoryBroker) Send(_ context.Context, topic string, key string, value []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+
+	m := BrokerMessage{Topic: topic, Key: key, Value: value}
+	b.messages = append(b.messages, m)
+
+	for ch, prefix := range b.subs {
+		if strings.HasPrefix(topic, prefix) {
+			select {
+			case ch <- m:
+			default:
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *MemoryBroker) Flush(_ context.Context) error {
+	return nil
+}
+
+// Subscribe returns a buffered channel of the new messages with the topic prefix.
+func (b *MemoryBroker) Subscribe(prefix string, buffer int) <-chan BrokerMessage {
+	ch := make(chan BrokerMessage, buffer)
+
+	b.mutex.Lock()
+	b.subs[ch] = prefix
+	b.mutex.Unlock()
+
+	return ch
+}
+
+// Messages returns all messages sent so far.
+func (b *MemoryBroker) Messages() []BrokerMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	result := make([]BrokerMessage, len(b.messages))
+	copy(result, b.messages)
+
+	return result
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		for ch := range b.subs {
+			close(ch)
+		}
+	}
+
+	return nil
+}
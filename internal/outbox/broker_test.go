@@ -0,0 +1,90 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+func testMessages() []storage.OutboxMessage {
+	at := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	return []storage.OutboxMessage{
+		{ID: 1, Type: "order.added", Payload: []byte(`{"order":"12345678903"}`), CreatedAt: at},
+		{ID: 2, Type: "balance.withdrawn", Payload: []byte(`{"amount":10}`), CreatedAt: at},
+	}
+}
+
+func TestBrokerPublisher(t *testing.T) {
+	b := NewMemoryBroker()
+	orders := b.Subscribe("loyalty.order.", 10)
+	p := NewBrokerPublisher(b, "loyalty")
+
+	err := p.Publish(context.Background(), testMessages())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := b.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	if msgs[0].Topic != "loyalty.order.added" || msgs[0].Key != "1" || msgs[1].Topic != "loyalty.balance.withdrawn" {
+		t.Errorf("unexpected messages %+v", msgs)
+	}
+
+	var m Message
+	if err = json.Unmarshal(msgs[1].Value, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 2 || m.Type != "balance.withdrawn" || string(m.Payload) != `{"amount":10}` {
+		t.Errorf("unexpected wire message %+v", m)
+	}
+
+	select {
+	case got := <-orders:
+		if got.Topic != "loyalty.order.added" {
+			t.Errorf("subscriber got %s", got.Topic)
+		}
+	default:
+		t.Error("subscriber got nothing")
+	}
+	select {
+	case got := <-orders:
+		t.Errorf("subscriber got a message of another prefix %s", got.Topic)
+	default:
+	}
+}
+
+func TestBrokerPublisherNoPrefix(t *testing.T) {
+	b := NewMemoryBroker()
+	p := NewBrokerPublisher(b, "")
+
+	if err := p.Publish(context.Background(), testMessages()[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if topic := b.Messages()[0].Topic; topic != "order.added" {
+		t.Errorf("topic = %s, want order.added", topic)
+	}
+}
+
+func TestMemoryBrokerClosed(t *testing.T) {
+	b := NewMemoryBroker()
+	sub := b.Subscribe("", 1)
+	p := NewBrokerPublisher(b, "loyalty")
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-sub; ok {
+		t.Error("subscription is open after close")
+	}
+
+	err := p.Publish(context.Background(), testMessages())
+	if !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("publish after close = %v, want ErrBrokerClosed", err)
+	}
+}
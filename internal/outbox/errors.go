@@ -0,0 +1,10 @@
+package outbox
+
+import (
+	"errors"
+)
+
+var (
+	ErrUnknownPublisher = errors.New("unknown outbox publisher")
+	ErrBrokerClosed     = errors.New("broker is closed")
+)
@@ -0,0 +1,167 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const natsDialTimeout = 5 * time.Second
+
+// NATSBroker is a minimal publish-only client of the NATS text protocol.
+// The connection is dialed lazily and redialed after any error.
+type NATSBroker struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	mutex  *sync.Mutex
+}
+
+func NewNATSBroker(addr string) *NATSBroker {
+	return &NATSBroker{addr: addr, mutex: &sync.Mutex{}}
+}
+
+func (b *NATSBroker) Send(ctx context.Context, topic string, _ string, value []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	// a full buffer is written out here, not by the next ping
+	b.setDeadline(ctx)
+	_, err = fmt.Fprintf(b.writer, "PUB %s %d\r\n", topic, len(value))
+	if err == nil {
+		_, err = b.writer.Write(value)
+	}
+	if err == nil {
+		_, err = b.writer.WriteString("\r\n")
+	}
+	if err != nil {
+		b.reset()
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+
+	return nil
+}
+
+// Flush sends PING and waits for PONG, which the server answers after
+// processing every preceding PUB, so protocol errors are reported here.
+func (b *NATSBroker) Flush(ctx context.Context) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = b.ping(ctx)
+	if err != nil {
+		b.reset()
+		return fmt.Errorf("failed to flush NATS connection: %w", err)
+	}
+
+	return nil
+}
+
+func (b *NATSBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.reset()
+	return nil
+}
+
+func (b *NATSBroker) connect(ctx context.Context) error {
+	if b.conn != nil {
+		return nil
+	}
+
+	d := net.Dialer{Timeout: natsDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	b.conn = conn
+	b.reader = bufio.NewReader(conn)
+	b.writer = bufio.NewWriter(conn)
+
+	// the server greets with INFO
+	b.setDeadline(ctx)
+	line, err := b.reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		b.reset()
+		return fmt.Errorf("unexpected NATS greeting %q: %v", line, err)
+	}
+
+	_, err = b.writer.WriteString(`CONNECT {"verbose":false,"pedantic":false,"name":"loyalty-service"}` + "\r\n")
+	if err == nil {
+		err = b.ping(ctx)
+	}
+	if err != nil {
+		b.reset()
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	return nil
+}
+
+func (b *NATSBroker) ping(ctx context.Context) error {
+	b.setDeadline(ctx)
+
+	_, err := b.writer.WriteString("PING\r\n")
+	if err != nil {
+		return err
+	}
+	err = b.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err := b.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err = b.writer.WriteString("PONG\r\n"); err == nil {
+				err = b.writer.Flush()
+			}
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", line)
+		}
+	}
+}
+
+func (b *NATSBroker) setDeadline(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(natsDialTimeout)
+	}
+	b.conn.SetDeadline(deadline)
+}
+
+func (b *NATSBroker) reset() {
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	b.conn = nil
+	b.reader = nil
+	b.writer = nil
+}
@@ -0,0 +1,213 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natsServer is a fake NATS server speaking enough of the protocol for NATSBroker.
+type natsServer struct {
+	ln       net.Listener
+	mutex    sync.Mutex
+	pubs     []string // "<subject> <payload>"
+	connects int
+	errOnPub string // answer every PUB with -ERR when set
+}
+
+func newNATSServer(t *testing.T) *natsServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &natsServer{ln: ln}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+
+	return s
+}
+
+func (s *natsServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *natsServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "INFO {\"server_id\":\"test\"}\r\n")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "CONNECT "):
+			s.mutex.Lock()
+			s.connects++
+			s.mutex.Unlock()
+		case line == "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case strings.HasPrefix(line, "PUB "):
+			parts := strings.Fields(line)
+			size, _ := strconv.Atoi(parts[len(parts)-1])
+			payload := make([]byte, size+2)
+			if _, err = io.ReadFull(r, payload); err != nil {
+				return
+			}
+
+			s.mutex.Lock()
+			s.pubs = append(s.pubs, parts[1]+" "+string(payload[:size]))
+			errOnPub := s.errOnPub
+			s.mutex.Unlock()
+
+			if errOnPub != "" {
+				fmt.Fprintf(conn, "-ERR '%s'\r\n", errOnPub)
+			}
+		}
+	}
+}
+
+func (s *natsServer) published() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]string(nil), s.pubs...)
+}
+
+func TestNATSBrokerPublish(t *testing.T) {
+	srv := newNATSServer(t)
+	b := NewNATSBroker(srv.ln.Addr().String())
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p := NewBrokerPublisher(b, "loyalty")
+	if err := p.Publish(ctx, testMessages()); err != nil {
+		t.Fatal(err)
+	}
+
+	pubs := srv.published()
+	if len(pubs) != 2 {
+		t.Fatalf("server got %d messages, want 2", len(pubs))
+	}
+	if !strings.HasPrefix(pubs[0], `loyalty.order.added {"id":1,`) {
+		t.Errorf("unexpected first message %q", pubs[0])
+	}
+	if !strings.HasPrefix(pubs[1], "loyalty.balance.withdrawn ") {
+		t.Errorf("unexpected second message %q", pubs[1])
+	}
+}
+
+func TestNATSBrokerServerError(t *testing.T) {
+	srv := newNATSServer(t)
+	srv.errOnPub = "Permissions Violation"
+	b := NewNATSBroker(srv.ln.Addr().String())
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := b.Send(ctx, "loyalty.order.added", "1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	err := b.Flush(ctx)
+	if err == nil || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Errorf("flush = %v, want the server error", err)
+	}
+}
+
+func TestNATSBrokerReconnect(t *testing.T) {
+	srv := newNATSServer(t)
+	b := NewNATSBroker(srv.ln.Addr().String())
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a dropped connection fails the next flush and is redialed after it
+	b.mutex.Lock()
+	b.conn.Close()
+	b.mutex.Unlock()
+
+	if err := b.Flush(ctx); err == nil {
+		t.Error("flush over a closed connection succeeded")
+	}
+	if err := b.Flush(ctx); err != nil {
+		t.Errorf("flush after reconnect = %v", err)
+	}
+
+	srv.mutex.Lock()
+	connects := srv.connects
+	srv.mutex.Unlock()
+	if connects != 2 {
+		t.Errorf("server got %d connections, want 2", connects)
+	}
+}
+
+func TestNATSBrokerStaleDeadline(t *testing.T) {
+	srv := newNATSServer(t)
+	b := NewNATSBroker(srv.ln.Addr().String())
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	// the deadline of the earlier flush has passed, a batch larger than the
+	// write buffer is still sent
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	value := []byte(strings.Repeat("x", 8192))
+	for i := 0; i < 2; i++ {
+		if err := b.Send(ctx, "loyalty.x", strconv.Itoa(i), value); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(srv.published()); got != 2 {
+		t.Errorf("server got %d messages, want 2", got)
+	}
+}
+
+func TestNATSBrokerUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	b := NewNATSBroker(addr)
+	if err = b.Send(context.Background(), "loyalty.x", "1", []byte("{}")); err == nil {
+		t.Error("send to an unreachable server succeeded")
+	}
+}
@@ -0,0 +1,127 @@
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+const (
+	relayBatch     = 100
+	relayTimeout   = 30 * time.Second
+	purgeInterval  = time.Hour
+	purgeRetention = 7 * 24 * time.Hour
+)
+
+// Relay publishes outbox messages written by the storage. Delivery is at
+// least once: a batch is marked as published in the same transaction that
+// locked it, after the publisher has accepted it.
+type Relay struct {
+	storage   storage.Service
+	publisher Publisher
+	tick      *time.Ticker // Тикер для проверки неопубликованных сообщений
+}
+
+func NewRelay(str storage.Service, pub Publisher) Relay {
+	r := Relay{
+		storage:   str,
+		publisher: pub,
+		tick:      time.NewTicker(time.Second),
+	}
+
+	go r.relay()
+
+	return r
+}
+
+func (r *Relay) relay() {
+	for range r.tick.C {
+		for {
+			n, err := r.publishBatch()
+			if err != nil {
+				slog.Error("Failed to publish outbox", "error", err)
+				break
+			}
+			if n < relayBatch {
+				break
+			}
+		}
+	}
+}
+
+func (r *Relay) publishBatch() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), relayTimeout)
+	defer cancel()
+
+	n := 0
+	err := r.storage.WithTx(ctx, func(tx storage.Tx) error {
+		msgs, err := tx.GetOutbox(ctx, relayBatch)
+		if err != nil {
+			return err
+		}
+
+		n = len(msgs)
+		if n == 0 {
+			return nil
+		}
+
+		err = r.publisher.Publish(ctx, msgs)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]uint64, 0, n)
+		for _, m := range msgs {
+			ids = append(ids, m.ID)
+		}
+
+		return tx.MarkOutboxPublished(ctx, ids)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Purger deletes outbox messages older than the retention. Unpublished
+// messages are deleted too when publishing is disabled, as nothing would
+// ever relay them. It runs apart from the relay, which is started only
+// with a publisher, while the storage writes the outbox anyway.
+type Purger struct {
+	storage     storage.Service
+	unpublished bool
+	tick        *time.Ticker // Тикер для удаления устаревших сообщений
+}
+
+func NewPurger(str storage.Service, unpublished bool) Purger {
+	p := Purger{
+		storage:     str,
+		unpublished: unpublished,
+		tick:        time.NewTicker(purgeInterval),
+	}
+
+	go func() {
+		for range p.tick.C {
+			p.purge()
+		}
+	}()
+
+	return p
+}
+
+func (p *Purger) purge() {
+	ctx, cancel := context.WithTimeout(context.Background(), relayTimeout)
+	defer cancel()
+
+	n, err := p.storage.PurgeOutbox(ctx, time.Now().Add(-purgeRetention), p.unpublished)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to purge outbox", "error", err)
+		return
+	}
+	if n > 0 {
+		slog.InfoContext(ctx, "Purged outbox messages", "count", n)
+	}
+}
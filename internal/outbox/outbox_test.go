@@ -0,0 +1,114 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// fakeStorage keeps the outbox in memory, other storage methods are not implemented.
+type fakeStorage struct {
+	storage.Service
+	outbox    []storage.OutboxMessage
+	published []uint64
+	purged    []bool // unpublished argument of every purge
+}
+
+func (s *fakeStorage) WithTx(ctx context.Context, fn func(tx storage.Tx) error) error {
+	published := s.published
+	err := fn(s)
+	if err != nil {
+		s.published = published
+	}
+	return err
+}
+
+func (s *fakeStorage) GetOutbox(_ context.Context, limit int) ([]storage.OutboxMessage, error) {
+	var result []storage.OutboxMessage
+	for _, m := range s.outbox {
+		if !s.isPublished(m.ID) && len(result) < limit {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+func (s *fakeStorage) MarkOutboxPublished(_ context.Context, ids []uint64) error {
+	s.published = append(s.published, ids...)
+	return nil
+}
+
+func (s *fakeStorage) PurgeOutbox(_ context.Context, _ time.Time, unpublished bool) (int64, error) {
+	s.purged = append(s.purged, unpublished)
+	return 0, nil
+}
+
+func (s *fakeStorage) isPublished(id uint64) bool {
+	for _, v := range s.published {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+type failingBroker struct {
+	*MemoryBroker
+	fail bool
+}
+
+func (b *failingBroker) Flush(ctx context.Context) error {
+	if b.fail {
+		return errors.New("broker is down")
+	}
+	return b.MemoryBroker.Flush(ctx)
+}
+
+func TestRelayPublishBatch(t *testing.T) {
+	str := &fakeStorage{outbox: testMessages()}
+	broker := &failingBroker{MemoryBroker: NewMemoryBroker(), fail: true}
+	r := Relay{storage: str, publisher: NewBrokerPublisher(broker, "loyalty")}
+
+	// a failed batch stays unpublished and is sent again
+	if _, err := r.publishBatch(); err == nil {
+		t.Fatal("publish to a failing broker succeeded")
+	}
+	if len(str.published) != 0 {
+		t.Fatalf("failed batch is marked published: %v", str.published)
+	}
+
+	broker.fail = false
+	n, err := r.publishBatch()
+	if err != nil || n != 2 {
+		t.Fatalf("publishBatch = %d, %v, want 2 messages", n, err)
+	}
+	if len(str.published) != 2 {
+		t.Errorf("published ids %v, want 2", str.published)
+	}
+
+	n, err = r.publishBatch()
+	if err != nil || n != 0 {
+		t.Errorf("publishBatch of an empty outbox = %d, %v", n, err)
+	}
+
+	// at least once: the failed attempt was sent too, consumers dedupe by ID
+	if got := len(broker.Messages()); got != 4 {
+		t.Errorf("broker got %d messages, want 4", got)
+	}
+}
+
+func TestPurgerUnpublished(t *testing.T) {
+	str := &fakeStorage{}
+
+	for _, unpublished := range []bool{false, true} {
+		p := Purger{storage: str, unpublished: unpublished}
+		p.purge()
+	}
+
+	if len(str.purged) != 2 || str.purged[0] || !str.purged[1] {
+		t.Errorf("got purges %v, want published only and then unpublished too", str.purged)
+	}
+}
@@ -0,0 +1,115 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// Publisher delivers outbox messages to downstream systems. A batch is
+// published in order; on error the whole batch is retried later, so
+// consumers must tolerate duplicates and deduplicate by message ID.
+type Publisher interface {
+	Publish(ctx context.Context, msgs []storage.OutboxMessage) error
+	Close() error
+}
+
+// Message is the wire form of an outbox message.
+type Message struct {
+	ID        uint64          `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// NewPublisher makes a publisher from its config spec:
+//   - "" or "none" disables publishing;
+//   - "stdout" writes JSON lines to the standard output;
+//   - "file:<path>" appends JSON lines to the file;
+//   - "nats://host:port[/prefix]" publishes to NATS subjects "<prefix>.<type>",
+//     the prefix is "loyalty" by default.
+func NewPublisher(spec string) (Publisher, error) {
+	switch {
+	case spec == "" || spec == "none":
+		return nil, nil
+	case spec == "stdout":
+		return NewWriterPublisher(nopCloser{os.Stdout}), nil
+	case strings.HasPrefix(spec, "file:"):
+		return NewFilePublisher(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "nats://"):
+		addr := strings.TrimPrefix(spec, "nats://")
+		prefix := "loyalty"
+		if i := strings.Index(addr, "/"); i >= 0 {
+			addr, prefix = addr[:i], addr[i+1:]
+		}
+		return NewBrokerPublisher(NewNATSBroker(addr), prefix), nil
+	default:
+		return nil, fmt.Errorf("%w \"%s\"", ErrUnknownPublisher, spec)
+	}
+}
+
+func toMessage(m storage.OutboxMessage) Message {
+	return Message{
+		ID:        m.ID,
+		Type:      m.Type,
+		Payload:   m.Payload,
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+// WriterPublisher writes messages as JSON lines.
+type WriterPublisher struct {
+	w     io.WriteCloser
+	mutex *sync.Mutex
+}
+
+func NewWriterPublisher(w io.WriteCloser) *WriterPublisher {
+	return &WriterPublisher{w: w, mutex: &sync.Mutex{}}
+}
+
+// NewFilePublisher appends JSON lines to the file, creating it if needed.
+func NewFilePublisher(path string) (*WriterPublisher, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox file: %w", err)
+	}
+
+	return NewWriterPublisher(f), nil
+}
+
+func (p *WriterPublisher) Publish(_ context.Context, msgs []storage.OutboxMessage) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	enc := json.NewEncoder(p.w)
+	for _, m := range msgs {
+		if err := enc.Encode(toMessage(m)); err != nil {
+			return err
+		}
+	}
+
+	if f, ok := p.w.(*os.File); ok {
+		return f.Sync()
+	}
+
+	return nil
+}
+
+func (p *WriterPublisher) Close() error {
+	return p.w.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewPublisher(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+		err  error
+	}{
+		{"", "", nil},
+		{"none", "", nil},
+		{"stdout", "*outbox.WriterPublisher", nil},
+		{"nats://localhost:4222", "*outbox.BrokerPublisher", nil},
+		{"kafka://localhost:9092", "", ErrUnknownPublisher},
+	}
+
+	for _, tt := range tests {
+		p, err := NewPublisher(tt.spec)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("NewPublisher(%q) error = %v, want %v", tt.spec, err, tt.err)
+			continue
+		}
+		got := ""
+		if p != nil {
+			got = fmt.Sprintf("%T", p)
+		}
+		if got != tt.want {
+			t.Errorf("NewPublisher(%q) = %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestNATSPrefix(t *testing.T) {
+	p, err := NewPublisher("nats://localhost:4222/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp := p.(*BrokerPublisher)
+	if bp.prefix != "events" || bp.broker.(*NATSBroker).addr != "localhost:4222" {
+		t.Errorf("prefix %q, address %q", bp.prefix, bp.broker.(*NATSBroker).addr)
+	}
+}
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+
+	p, err := NewPublisher("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Publish(context.Background(), testMessages()); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var ids []uint64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var m Message
+		if err = json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("bad line %q: %v", sc.Text(), err)
+		}
+		ids = append(ids, m.ID)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("file has messages %v, want [1 2]", ids)
+	}
+}
@@ -0,0 +1,87 @@
+package points
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/metrics"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+const (
+	expiryInterval = time.Hour
+	expiryBatch    = 100
+)
+
+// Policy sets the lifetime of credited points in months, zero keeps them forever.
+type Policy struct {
+	Months int
+}
+
+// ExpiresAt returns the expiry of points credited at t, zero if they never expire.
+func (p Policy) ExpiresAt(t time.Time) time.Time {
+	if p.Months <= 0 {
+		return time.Time{}
+	}
+	return t.AddDate(0, p.Months, 0)
+}
+
+// Expirer writes off expired points on schedule.
+type Expirer struct {
+	storage storage.Service
+	events  events.Publisher
+	tick    *time.Ticker // Тикер для списания истекших баллов
+}
+
+func NewExpirer(str storage.Service, pub events.Publisher) Expirer {
+	e := Expirer{
+		storage: str,
+		events:  pub,
+		tick:    time.NewTicker(expiryInterval),
+	}
+
+	go e.expire()
+
+	return e
+}
+
+func (e *Expirer) expire() {
+	for range e.tick.C {
+		for {
+			n, err := e.expireBatch()
+			if err != nil {
+				slog.Error("Failed to expire points", "error", err)
+				break
+			}
+			if n < expiryBatch {
+				break
+			}
+		}
+	}
+}
+
+func (e *Expirer) expireBatch() (int, error) {
+	ctx := context.Background()
+
+	expired, err := e.storage.ExpirePoints(ctx, time.Now(), expiryBatch)
+	for _, p := range expired {
+		slog.InfoContext(ctx, "Points expired", "user_id", p.UserID, "amount", p.Amount)
+		metrics.PointsExpired.Add(p.Amount)
+		if e.events == nil {
+			continue
+		}
+		ev := events.Event{
+			Type:   events.PointsExpired,
+			UserID: p.UserID,
+			Amount: p.Amount,
+			Time:   time.Now(),
+		}
+		if err := e.events.Publish(ctx, ev); err != nil {
+			slog.ErrorContext(ctx, "Failed to publish points expiry", "error", err)
+		}
+	}
+
+	return len(expired), err
+}
@@ -0,0 +1,9 @@
+package referral
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidReferralCode = errors.New("invalid referral code")
+)
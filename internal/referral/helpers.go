@@ -0,0 +1,82 @@
+package referral
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+// codeAlphabet has no look-alike characters
+const (
+	codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	codeLength   = 8
+	// codeAttempts is the number of codes tried for a user before giving up
+	codeAttempts = 5
+	// codeConstraint is the unique constraint of USERS.REFERRAL_CODE
+	codeConstraint = "users_referral_code_key"
+)
+
+func generateCode() (string, error) {
+	var b strings.Builder
+	for i := 0; i < codeLength; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(codeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// isCodeTaken tells whether err is a violation of the referral code uniqueness.
+func isCodeTaken(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation && pgErr.ConstraintName == codeConstraint
+}
+
+// Fingerprint identifies the client device by its ID header, falling back
+// to the user agent.
+func Fingerprint(deviceID string, userAgent string) string {
+	src := deviceID
+	if src == "" {
+		src = userAgent
+	}
+	if src == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(src))
+	return hex.EncodeToString(sum[:16])
+}
+
+// sameNetwork tells whether the addresses share a /24 IPv4 or /64 IPv6 network.
+func sameNetwork(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return false
+	}
+
+	mask := net.CIDRMask(64, 128)
+	if ipA.To4() != nil && ipB.To4() != nil {
+		ipA, ipB = ipA.To4(), ipB.To4()
+		mask = net.CIDRMask(24, 32)
+	}
+
+	return ipA.Mask(mask).Equal(ipB.Mask(mask))
+}
+
+// maskLogin hides the login of a referred user but its first letters.
+func maskLogin(login string) string {
+	r := []rune(login)
+	if len(r) <= 2 {
+		return strings.Repeat("*", len(r))
+	}
+	return string(r[:2]) + strings.Repeat("*", len(r)-2)
+}
@@ -0,0 +1,148 @@
+package referral
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/auth"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// referral statuses
+const (
+	StatusPending  = "PENDING"
+	StatusRewarded = "REWARDED"
+	StatusRejected = "REJECTED"
+)
+
+// reasons to reject a referral
+const (
+	reasonSameDevice  = "same device as the referrer"
+	reasonSameNetwork = "same network as the referrer"
+)
+
+// Config sets the points credited to both users and how many referrals
+// of one referrer are rewarded.
+type Config struct {
+	ReferrerBonus float64
+	ReferredBonus float64
+	MaxRewarded   int
+}
+
+// Summary is the referral code of a user, the referred users and the bonus earned for them.
+type Summary struct {
+	Code      string             `json:"code"`
+	Earned    float64            `json:"earned"`
+	Referrals []storage.Referral `json:"referrals"`
+}
+
+type Service struct {
+	storage storage.Service
+	config  Config
+}
+
+func NewService(str storage.Service, cfg Config) Service {
+	return Service{storage: str, config: cfg}
+}
+
+// SignedUp gives the new user a referral code and records the referral by
+// the code of the sign up request, see auth.SignUpHook. Suspicious referrals
+// are recorded as rejected and are never rewarded.
+func (s *Service) SignedUp(ctx context.Context, tx storage.Tx, userID uint64, cred auth.Credentials, client auth.Client) error {
+	err := s.setSignupInfo(ctx, tx, storage.SignupInfo{UserID: userID, IP: client.IP, Device: client.Device})
+	if err != nil {
+		return err
+	}
+
+	refCode := strings.ToUpper(strings.TrimSpace(cred.ReferralCode))
+	if refCode == "" {
+		return nil
+	}
+
+	referrer, err := tx.GetUserByReferralCode(ctx, refCode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInvalidReferralCode
+	}
+	if err != nil {
+		return err
+	}
+
+	ref := storage.Referral{ReferrerID: referrer.UserID, ReferredID: userID, Status: StatusPending}
+	switch {
+	case client.Device != "" && client.Device == referrer.Device:
+		ref.Reason = reasonSameDevice
+	case sameNetwork(client.IP, referrer.IP):
+		ref.Reason = reasonSameNetwork
+	}
+	if ref.Reason != "" {
+		ref.Status = StatusRejected
+		slog.WarnContext(ctx, "Referral rejected", "user_id", userID, "referrer_id", referrer.UserID, "reason", ref.Reason)
+	}
+
+	return tx.AddReferral(ctx, ref)
+}
+
+// setSignupInfo stores the info with a new referral code, generating
+// another one while the code is taken.
+func (s *Service) setSignupInfo(ctx context.Context, tx storage.Tx, info storage.SignupInfo) error {
+	var err error
+	for i := 0; i < codeAttempts; i++ {
+		info.ReferralCode, err = generateCode()
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetSignupInfo(ctx, info)
+		if !isCodeTaken(err) {
+			return err
+		}
+	}
+
+	// the unique violation must not pass for a taken username
+	return fmt.Errorf("failed to generate a unique referral code: %v", err)
+}
+
+// Bonuses credits both users on the first processed order of a referred
+// user, see accrual.Bonus.
+func (s *Service) Bonuses(ctx context.Context, tx storage.Tx, userID uint64, accrual storage.Accrual) ([]storage.Credit, error) {
+	if s.config.ReferrerBonus <= 0 && s.config.ReferredBonus <= 0 {
+		return nil, nil
+	}
+
+	ref, ok, err := tx.RewardReferral(ctx, userID, s.config.ReferrerBonus, s.config.ReferredBonus, s.config.MaxRewarded)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	credits := []storage.Credit{{UserID: ref.ReferredID, Kind: storage.LedgerReferral, Amount: ref.ReferredBonus}}
+	if ref.ReferrerBonus > 0 {
+		credits = append(credits, storage.Credit{UserID: ref.ReferrerID, Kind: storage.LedgerReferral, Amount: ref.ReferrerBonus})
+	}
+
+	return credits, nil
+}
+
+func (s *Service) Summary(ctx context.Context, userID uint64) (Summary, error) {
+	info, err := s.storage.GetSignupInfo(ctx, userID)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	referrals, err := s.storage.GetReferrals(ctx, userID)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	result := Summary{Code: info.ReferralCode, Referrals: make([]storage.Referral, 0, len(referrals))}
+	for _, r := range referrals {
+		r.Login = maskLogin(r.Login)
+		result.Earned += r.ReferrerBonus
+		result.Referrals = append(result.Referrals, r)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,110 @@
+package referral
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/moorzeen/loyalty-service/internal/auth"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// codeStorage rejects the first taken codes as the referral code constraint would.
+type codeStorage struct {
+	storage.Service
+	taken int
+	codes []string
+}
+
+func (s *codeStorage) SetSignupInfo(_ context.Context, info storage.SignupInfo) error {
+	s.codes = append(s.codes, info.ReferralCode)
+	if len(s.codes) <= s.taken {
+		return &pgconn.PgError{Code: pgerrcode.UniqueViolation, ConstraintName: codeConstraint}
+	}
+	return nil
+}
+
+func TestSignedUpRetriesTakenCode(t *testing.T) {
+	str := &codeStorage{taken: 2}
+	s := NewService(str, Config{})
+
+	err := s.SignedUp(context.Background(), str, 1, auth.Credentials{Username: "user"}, auth.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(str.codes) != 3 {
+		t.Errorf("tried %d codes, want 3", len(str.codes))
+	}
+}
+
+func TestSignedUpGivesUp(t *testing.T) {
+	str := &codeStorage{taken: codeAttempts}
+	s := NewService(str, Config{})
+
+	err := s.SignedUp(context.Background(), str, 1, auth.Credentials{Username: "user"}, auth.Client{})
+	if err == nil {
+		t.Fatal("sign up succeeded with every code taken")
+	}
+
+	// auth.SignUp must not report it as a taken username
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		t.Errorf("error %v exposes the unique violation", err)
+	}
+	if len(str.codes) != codeAttempts {
+		t.Errorf("tried %d codes, want %d", len(str.codes), codeAttempts)
+	}
+}
+
+func TestGenerateCode(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code, err := generateCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != codeLength || strings.Trim(code, codeAlphabet) != "" {
+			t.Fatalf("code %q is not %d characters of the alphabet", code, codeLength)
+		}
+	}
+}
+
+func TestIsCodeTaken(t *testing.T) {
+	tests := []struct {
+		err   error
+		taken bool
+	}{
+		{&pgconn.PgError{Code: pgerrcode.UniqueViolation, ConstraintName: codeConstraint}, true},
+		{&pgconn.PgError{Code: pgerrcode.UniqueViolation, ConstraintName: "users_username_key"}, false},
+		{&pgconn.PgError{Code: pgerrcode.ForeignKeyViolation, ConstraintName: codeConstraint}, false},
+		{errors.New("connection refused"), false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := isCodeTaken(tt.err); got != tt.taken {
+			t.Errorf("isCodeTaken(%v) = %v, want %v", tt.err, got, tt.taken)
+		}
+	}
+}
+
+func TestSameNetwork(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"203.0.113.5", "203.0.113.200", true},
+		{"203.0.113.5", "203.0.114.5", false},
+		{"2001:db8:1:2::1", "2001:db8:1:2::ff", true},
+		{"2001:db8:1:2::1", "2001:db8:1:3::1", false},
+		{"203.0.113.5", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := sameNetwork(tt.a, tt.b); got != tt.same {
+			t.Errorf("sameNetwork(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.same)
+		}
+	}
+}
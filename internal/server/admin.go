@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/moorzeen/loyalty-service/internal/order"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+func (ls *LoyaltyServer) addAccrualOrder(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
+		return
+	}
+
+	order := storage.AccrualOrder{}
+
+	err := json.NewDecoder(r.Body).Decode(&order)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse order: %s", err)
+		writeProblem(w, r, kindBadRequest, msg)
+		return
+	}
+
+	err = ls.rules.AddOrder(r.Context(), order)
+	if err != nil {
+		writeError(w, r, "Failed to add order", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (ls *LoyaltyServer) getAccrualRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := ls.rules.Rules(r.Context())
+	if err != nil {
+		writeError(w, r, "Failed to get rules", err)
+		return
+	}
+
+	if len(rules) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(&rules)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) addAccrualRule(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
+		return
+	}
+
+	rule := storage.AccrualRule{}
+
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse rule: %s", err)
+		writeProblem(w, r, kindBadRequest, msg)
+		return
+	}
+
+	rule.ID, err = ls.rules.AddRule(r.Context(), rule)
+	if err != nil {
+		writeError(w, r, "Failed to add rule", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(&rule)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) deleteAccrualRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, kindBadRequest, "Invalid rule ID")
+		return
+	}
+
+	err = ls.rules.DeleteRule(r.Context(), id)
+	if err != nil {
+		writeError(w, r, "Failed to delete rule", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ls *LoyaltyServer) reverseWithdrawal(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
+		return
+	}
+
+	req := order.Reversal{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse reversal: %s", err)
+		writeProblem(w, r, kindBadRequest, msg)
+		return
+	}
+	req.OrderNumber = chi.URLParam(r, "number")
+
+	rev, err := ls.order.ReverseWithdrawal(r.Context(), req)
+	if err != nil {
+		writeError(w, r, "Failed to reverse withdrawal", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(&rev)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) getCampaigns(w http.ResponseWriter, r *http.Request) {
+	campaigns, err := ls.campaign.List(r.Context())
+	if err != nil {
+		writeError(w, r, "Failed to get campaigns", err)
+		return
+	}
+
+	if len(campaigns) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(&campaigns)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) addCampaign(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
+		return
+	}
+
+	req := storage.Campaign{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse campaign: %s", err)
+		writeProblem(w, r, kindBadRequest, msg)
+		return
+	}
+
+	c, err := ls.campaign.Add(r.Context(), req)
+	if err != nil {
+		writeError(w, r, "Failed to add campaign", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(&c)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) endCampaign(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, kindBadRequest, "Invalid campaign ID")
+		return
+	}
+
+	err = ls.campaign.End(r.Context(), id)
+	if err != nil {
+		writeError(w, r, "Failed to end campaign", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"flag"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 )
@@ -10,6 +11,45 @@ type config struct {
 	RunAddress     string `env:"RUN_ADDRESS" envDefault:"localhost:8080"`
 	DatabaseURI    string `env:"DATABASE_URI" envDefault:"postgresql://localhost:5432/postgres?sslmode=disable"`
 	AccrualAddress string `env:"ACCRUAL_SYSTEM_ADDRESS" envDefault:"http://localhost:8080"`
+	// AccrualProviders lists extra "name=spec" providers, AccrualRoutes sends
+	// order number prefixes to them, see accrual.NewProvider
+	AccrualProviders string `env:"ACCRUAL_PROVIDERS"`
+	AccrualRoutes    string `env:"ACCRUAL_ROUTES"`
+	// AccrualBreakerThreshold failures in a row open the accrual system
+	// circuit for AccrualBreakerCoolDown
+	AccrualBreakerThreshold int           `env:"ACCRUAL_BREAKER_THRESHOLD" envDefault:"5"`
+	AccrualBreakerCoolDown  time.Duration `env:"ACCRUAL_BREAKER_COOLDOWN" envDefault:"30s"`
+	// AccrualRulesFile is a YAML or JSON list of the local accrual engine rules
+	AccrualRulesFile string `env:"ACCRUAL_RULES_FILE"`
+	// TrustedProxies are the comma separated addresses or CIDRs of the reverse
+	// proxies whose X-Forwarded-For and X-Real-IP headers tell the client address
+	TrustedProxies string `env:"TRUSTED_PROXIES"`
+	// AdminToken enables the /api/admin endpoints for Bearer requests with it
+	AdminToken string `env:"ADMIN_TOKEN"`
+	// OutboxPublisher is "none", "stdout", "file:<path>" or "nats://host:port[/prefix]"
+	OutboxPublisher string `env:"OUTBOX_PUBLISHER" envDefault:"none"`
+	// AccrualCallbackSecret enables POST /api/internal/accruals when set
+	AccrualCallbackSecret string        `env:"ACCRUAL_CALLBACK_SECRET"`
+	AccrualCallbackGrace  time.Duration `env:"ACCRUAL_CALLBACK_GRACE" envDefault:"30s"`
+	// PointsExpiryMonths is the lifetime of credited points, zero keeps them forever
+	PointsExpiryMonths int `env:"POINTS_EXPIRY_MONTHS" envDefault:"0"`
+	// Tiers are "name:min_points:min_orders:multiplier" definitions separated by
+	// commas, reached by activity within TierWindow, see tier.ParseTiers
+	Tiers      string        `env:"TIERS"`
+	TierWindow time.Duration `env:"TIER_WINDOW" envDefault:"8760h"`
+	// ReferrerBonus and ReferredBonus are credited on the first processed order
+	// of a referred user, the referrer gets it for up to ReferralCap users
+	ReferrerBonus float64 `env:"REFERRER_BONUS" envDefault:"0"`
+	ReferredBonus float64 `env:"REFERRED_BONUS" envDefault:"0"`
+	ReferralCap   int     `env:"REFERRAL_CAP" envDefault:"10"`
+	// HoldTTL is how long points are held when the hold request has no TTL
+	HoldTTL time.Duration `env:"HOLD_TTL" envDefault:"15m"`
+	// IdempotencyTTL is how long responses are replayed for Idempotency-Key retries
+	IdempotencyTTL time.Duration `env:"IDEMPOTENCY_TTL" envDefault:"24h"`
+	// LogLevel is "debug", "info", "warn" or "error"
+	LogLevel string `env:"LOG_LEVEL" envDefault:"info"`
+	// TracingExporter is "none", "stdout" or "otlp" configured by OTEL_EXPORTER_OTLP_* variables
+	TracingExporter string `env:"TRACING_EXPORTER" envDefault:"none"`
 }
 
 func GetConfig() (*config, error) {
@@ -23,6 +63,8 @@ func GetConfig() (*config, error) {
 	flag.StringVar(&config.RunAddress, "a", config.RunAddress, "server address and port")
 	flag.StringVar(&config.DatabaseURI, "d", config.DatabaseURI, "database URI")
 	flag.StringVar(&config.AccrualAddress, "r", config.AccrualAddress, "accrual system address")
+	flag.StringVar(&config.OutboxPublisher, "o", config.OutboxPublisher, "outbox publisher")
+	flag.StringVar(&config.LogLevel, "l", config.LogLevel, "log level")
 	flag.Parse()
 
 	return config, nil
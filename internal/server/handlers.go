@@ -2,22 +2,25 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/moorzeen/loyalty-service/internal/auth"
 	"github.com/moorzeen/loyalty-service/internal/order"
+	"github.com/moorzeen/loyalty-service/internal/tier"
 )
 
 func (ls *LoyaltyServer) register(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
 		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
 		return
 	}
 
@@ -26,23 +29,19 @@ func (ls *LoyaltyServer) register(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&cred)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to parse login or password: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeProblem(w, r, kindBadRequest, msg)
 		return
 	}
 
 	if cred.Username == "" || cred.Password == "" {
 		msg := "Empty login or password is not allowed"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeProblem(w, r, kindBadRequest, msg)
 		return
 	}
 
-	err = ls.auth.SignUp(r.Context(), cred)
+	err = ls.auth.SignUp(r.Context(), cred, signUpClient(r))
 	if err != nil {
-		msg := fmt.Sprintf("Can't regitser: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, errToStatus(err))
+		writeError(w, r, "Can't regitser", err)
 		return
 	}
 
@@ -53,8 +52,7 @@ func (ls *LoyaltyServer) login(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
 		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
 		return
 	}
 
@@ -63,23 +61,19 @@ func (ls *LoyaltyServer) login(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&cred)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to parse login or password: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeProblem(w, r, kindBadRequest, msg)
 		return
 	}
 
 	if cred.Username == "" || cred.Password == "" {
 		msg := "Empty login or password"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeProblem(w, r, kindBadRequest, msg)
 		return
 	}
 
 	authToken, err := ls.auth.SignIn(r.Context(), cred)
 	if err != nil {
-		msg := fmt.Sprintf("Can not login: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, errToStatus(err))
+		writeError(w, r, "Can not login", err)
 		return
 	}
 
@@ -95,39 +89,89 @@ func (ls *LoyaltyServer) newOrder(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "text/plain" {
 		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
 		return
 	}
 
 	orderNumber, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		msg := fmt.Sprintf("Filed to read request body: %s", err)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeProblem(w, r, kindBadRequest, msg)
 		return
 	}
 
 	userID := getUserID(r.Context())
 
 	err = ls.order.AddOrder(r.Context(), string(orderNumber), userID)
+	if errors.Is(err, order.ErrAlreadyAddByThis) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	if err != nil {
-		msg := fmt.Sprintf("Failed to add the order: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, errToStatus(err))
+		writeError(w, r, "Failed to add the order", err)
 		return
 	}
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
+func (ls *LoyaltyServer) newOrders(w http.ResponseWriter, r *http.Request) {
+	var numbers []string
+
+	switch contentType := r.Header.Get("Content-Type"); contentType {
+	case "application/json":
+		err := json.NewDecoder(r.Body).Decode(&numbers)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to parse order numbers: %s", err)
+			writeProblem(w, r, kindBadRequest, msg)
+			return
+		}
+	case "text/plain":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			msg := fmt.Sprintf("Filed to read request body: %s", err)
+			writeProblem(w, r, kindBadRequest, msg)
+			return
+		}
+		for _, line := range strings.Split(string(body), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				numbers = append(numbers, line)
+			}
+		}
+	default:
+		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
+		return
+	}
+
+	userID := getUserID(r.Context())
+
+	result, err := ls.order.AddOrders(r.Context(), numbers, userID)
+	if err != nil {
+		writeError(w, r, "Failed to add orders", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(&result)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
 func (ls *LoyaltyServer) getOrders(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r.Context())
 
-	orders, err := ls.order.GetOrders(r.Context(), userID)
+	opts, err := parseHistoryOptions(r)
+	if err != nil {
+		writeError(w, r, "Failed to get orders", err)
+		return
+	}
+
+	orders, next, err := ls.order.GetOrders(r.Context(), userID, opts)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to get order: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, errToStatus(err))
+		writeError(w, r, "Failed to get order", err)
 		return
 	}
 
@@ -148,39 +192,81 @@ func (ls *LoyaltyServer) getOrders(w http.ResponseWriter, r *http.Request) {
 		result = append(result, item)
 	}
 
+	setNextLink(w, r, next)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(&result)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) getOrder(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+	number := chi.URLParam(r, "number")
+
+	o, events, err := ls.order.GetOrder(r.Context(), number, userID)
+	if err != nil {
+		writeError(w, r, "Failed to get order", err)
 		return
 	}
+
+	result := order.Details{
+		Order: order.Order{
+			Number:     o.OrderNumber,
+			Status:     o.Status,
+			Accrual:    o.Accrual,
+			UploadedAt: o.UploadedAt,
+		},
+		History: make([]order.Event, 0, len(events)),
+	}
+
+	for _, v := range events {
+		item := order.Event{
+			Status:    v.Status,
+			Accrual:   v.Accrual,
+			ChangedAt: v.CreatedAt,
+		}
+		result.History = append(result.History, item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(&result)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
 }
 
 func (ls *LoyaltyServer) getBalance(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r.Context())
 
-	bal, wtn, err := ls.order.GetBalance(r.Context(), userID)
+	balance, err := ls.order.GetBalance(r.Context(), userID)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to get balance: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		writeError(w, r, "Failed to get balance", err)
 		return
 	}
 
-	result := order.Balance{
-		Balance:   bal,
-		Withdrawn: wtn,
+	type responseJSON struct {
+		order.Balance
+		Tier *tier.Progress `json:"tier,omitempty"`
+	}
+	result := responseJSON{Balance: balance}
+
+	if ls.tier.Enabled() {
+		progress, err := ls.tier.Progress(r.Context(), userID)
+		if err != nil {
+			writeError(w, r, "Failed to get tier", err)
+			return
+		}
+		result.Tier = &progress
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(&result)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
 	}
 }
 
@@ -188,8 +274,7 @@ func (ls *LoyaltyServer) withdraw(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
 		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
 		return
 	}
 
@@ -198,8 +283,7 @@ func (ls *LoyaltyServer) withdraw(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&wr)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to parse withdraw data: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeProblem(w, r, kindBadRequest, msg)
 		return
 	}
 
@@ -207,9 +291,7 @@ func (ls *LoyaltyServer) withdraw(w http.ResponseWriter, r *http.Request) {
 
 	err = ls.order.Withdraw(r.Context(), wr)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to withdraw: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, errToStatus(err))
+		writeError(w, r, "Failed to withdraw", err)
 		return
 	}
 
@@ -219,23 +301,29 @@ func (ls *LoyaltyServer) withdraw(w http.ResponseWriter, r *http.Request) {
 func (ls *LoyaltyServer) getWithdrawals(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r.Context())
 
-	withdrawals, err := ls.order.GetWithdrawals(r.Context(), userID)
+	opts, err := parseHistoryOptions(r)
+	if err != nil {
+		writeError(w, r, "Failed to get withdrawals", err)
+		return
+	}
+
+	withdrawals, next, err := ls.order.GetWithdrawals(r.Context(), userID, opts)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to get withdrawals: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, errToStatus(err))
+		writeError(w, r, "Failed to get withdrawals", err)
 		return
 	}
 
 	type responseJSON struct {
-		Number     string    `json:"order"`
-		Sum        float64   `json:"sum"`
-		UploadedAt time.Time `json:"processed_at"`
+		Number         string    `json:"order"`
+		Sum            float64   `json:"sum"`
+		UploadedAt     time.Time `json:"processed_at"`
+		Reversed       float64   `json:"reversed,omitempty"`
+		ReversalStatus string    `json:"reversal_status"`
 	}
 	result := make([]responseJSON, 0)
 
 	for _, v := range withdrawals {
-		item := responseJSON{v.OrderNumber, v.Sum, v.ProcessedAt}
+		item := responseJSON{v.OrderNumber, v.Sum, v.ProcessedAt, v.Reversed, order.ReversalStatus(v)}
 		result = append(result, item)
 	}
 
@@ -244,12 +332,50 @@ func (ls *LoyaltyServer) getWithdrawals(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	setNextLink(w, r, next)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(&result)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) getTierHistory(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+
+	history, err := ls.tier.History(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, "Failed to get tier history", err)
+		return
+	}
+
+	if len(history) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(&history)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) getReferrals(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+
+	result, err := ls.referral.Summary(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, "Failed to get referrals", err)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(&result)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
 }
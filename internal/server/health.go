@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/accrual"
+)
+
+const (
+	componentUp       = "up"
+	componentDown     = "down"
+	componentDegraded = "degraded"
+
+	readinessTimeout = 2 * time.Second
+	// workerStaleAfter without a scan for new orders marks the accrual worker down,
+	// the first scan is awaited as long after the start
+	workerStaleAfter = time.Minute
+)
+
+type componentHealth struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type readiness struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentHealth `json:"components"`
+}
+
+// liveness reports that the process is up and serving.
+func (ls *LoyaltyServer) liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write([]byte(`{"status":"up"}`))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write liveness", "error", err)
+	}
+}
+
+// readiness checks the dependencies. It responds 503 when the database is
+// unreachable or its schema is not at the expected version, or when the accrual
+// worker is stuck. Open accrual circuits only degrade the status: every replica
+// shares the accrual system, so taking this one out of rotation won't help.
+func (ls *LoyaltyServer) readiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	result := readiness{
+		Status: componentUp,
+		Components: map[string]componentHealth{
+			"database":         ls.databaseHealth(ctx),
+			"migrations":       ls.migrationsHealth(ctx),
+			"accrual_worker":   ls.accrualWorkerHealth(),
+			"accrual_circuits": ls.accrualCircuitsHealth(),
+		},
+	}
+
+	for _, c := range result.Components {
+		switch {
+		case c.Status == componentDown:
+			result.Status = componentDown
+		case c.Status == componentDegraded && result.Status == componentUp:
+			result.Status = componentDegraded
+		}
+	}
+
+	status := http.StatusOK
+	if result.Status == componentDown {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(&result)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode readiness", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) databaseHealth(ctx context.Context) componentHealth {
+	err := ls.storage.Ping(ctx)
+	if err != nil {
+		return componentHealth{Status: componentDown, Error: err.Error()}
+	}
+	return componentHealth{Status: componentUp}
+}
+
+func (ls *LoyaltyServer) migrationsHealth(ctx context.Context) componentHealth {
+	type details struct {
+		Version  uint `json:"version"`
+		Expected uint `json:"expected"`
+		Dirty    bool `json:"dirty"`
+	}
+
+	version, dirty, err := ls.storage.SchemaVersion(ctx)
+	if err != nil {
+		return componentHealth{Status: componentDown, Error: err.Error()}
+	}
+
+	h := componentHealth{
+		Status:  componentUp,
+		Details: details{Version: version, Expected: ls.schemaVersion, Dirty: dirty},
+	}
+	switch {
+	case dirty:
+		h.Status, h.Error = componentDown, "last migration failed"
+	case version != ls.schemaVersion:
+		h.Status, h.Error = componentDown, "unexpected schema version"
+	}
+	return h
+}
+
+func (ls *LoyaltyServer) accrualWorkerHealth() componentHealth {
+	stats := ls.accrual.Stats()
+
+	last := stats.LastScan
+	if last.IsZero() {
+		last = stats.Started
+	}
+
+	h := componentHealth{Status: componentUp, Details: stats}
+	if time.Since(last) > workerStaleAfter {
+		h.Status, h.Error = componentDown, "no scan for new orders since "+last.Format(time.RFC3339)
+	}
+	return h
+}
+
+func (ls *LoyaltyServer) accrualCircuitsHealth() componentHealth {
+	breakers := ls.provider.Breakers()
+
+	h := componentHealth{Status: componentUp, Details: breakers}
+	for _, b := range breakers {
+		if b.State != accrual.StateClosed {
+			h.Status, h.Error = componentDegraded, "accrual provider circuit is not closed"
+		}
+	}
+	return h
+}
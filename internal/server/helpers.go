@@ -2,42 +2,168 @@ package server
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/moorzeen/loyalty-service/internal/auth"
 	"github.com/moorzeen/loyalty-service/internal/order"
+	"github.com/moorzeen/loyalty-service/internal/referral"
 )
 
 func getUserID(ctx context.Context) uint64 {
 	return ctx.Value(UserIDContextKey).(uint64)
 }
 
-func errToStatus(err error) int {
-	switch {
-	case
-		errors.Is(err, auth.ErrShortPassword):
-		return http.StatusBadRequest
-	case
-		errors.Is(err, auth.ErrUsernameTaken) ||
-			errors.Is(err, order.ErrAddedByOther):
-		return http.StatusConflict
-	case
-		errors.Is(err, auth.ErrInvalidUser) ||
-			errors.Is(err, auth.ErrInvalidAuthToken) ||
-			errors.Is(err, auth.ErrNoUser) ||
-			errors.Is(err, auth.ErrWrongPassword):
-		return http.StatusUnauthorized
-	case
-		errors.Is(err, order.ErrInvalidOrderNumber):
-		return http.StatusUnprocessableEntity
-	case
-		errors.Is(err, order.ErrAlreadyAddByThis):
-		return http.StatusOK
-	case
-		errors.Is(err, order.ErrInsufficientFunds):
-		return http.StatusPaymentRequired
+// signUpClient identifies the client by its address, set by the RealIP
+// middleware from trusted proxies only, and by its device.
+func signUpClient(r *http.Request) auth.Client {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	return auth.Client{
+		IP:     ip,
+		Device: referral.Fingerprint(r.Header.Get("X-Device-ID"), r.UserAgent()),
+	}
+}
+
+// parseTrustedProxies reads comma separated addresses and CIDRs.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy \"%s\"", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy \"%s\": %w", v, err)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the request peer, or of the client behind
+// the trusted proxies when the peer is one of them.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if ip := net.ParseIP(peer); ip == nil || !isTrusted(ip, trusted) {
+		return peer
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			ip := net.ParseIP(hop)
+			if ip == nil {
+				break
+			}
+			if !isTrusted(ip, trusted) {
+				return hop
+			}
+			peer = hop
+		}
+		return peer
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return peer
+}
+
+// parseHistoryOptions reads the history paging and filter parameters:
+// limit, cursor, status (repeated or comma separated), from, to (RFC 3339)
+// and sort (asc or desc).
+func parseHistoryOptions(r *http.Request) (order.HistoryOptions, error) {
+	opts := order.HistoryOptions{}
+	q := r.URL.Query()
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return opts, fmt.Errorf("%w: bad limit \"%s\"", order.ErrInvalidFilter, v)
+		}
+		opts.Limit = limit
+	}
+
+	opts.Cursor = q.Get("cursor")
+
+	for _, v := range q["status"] {
+		for _, st := range strings.Split(v, ",") {
+			if st = strings.ToUpper(strings.TrimSpace(st)); st != "" {
+				opts.Statuses = append(opts.Statuses, st)
+			}
+		}
+	}
+
+	var err error
+	if v := q.Get("from"); v != "" {
+		opts.From, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return opts, fmt.Errorf("%w: bad from \"%s\"", order.ErrInvalidFilter, v)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		opts.To, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return opts, fmt.Errorf("%w: bad to \"%s\"", order.ErrInvalidFilter, v)
+		}
+	}
+
+	switch v := strings.ToLower(q.Get("sort")); v {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
 	default:
-		return http.StatusInternalServerError
+		return opts, fmt.Errorf("%w: bad sort \"%s\"", order.ErrInvalidFilter, v)
+	}
+
+	return opts, nil
+}
+
+// setNextLink points the Link header to the next page of the same request.
+func setNextLink(w http.ResponseWriter, r *http.Request, cursor string) {
+	if cursor == "" {
+		return
 	}
+
+	q := r.URL.Query()
+	q.Set("cursor", cursor)
+	next := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
 }
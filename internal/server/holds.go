@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/moorzeen/loyalty-service/internal/order"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+func (ls *LoyaltyServer) addHold(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
+		return
+	}
+
+	req := order.HoldRequest{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse hold: %s", err)
+		writeProblem(w, r, kindBadRequest, msg)
+		return
+	}
+
+	req.UserID = getUserID(r.Context())
+
+	hold, err := ls.order.AddHold(r.Context(), req)
+	if err != nil {
+		writeError(w, r, "Failed to hold points", err)
+		return
+	}
+
+	writeHold(w, r, http.StatusCreated, hold)
+}
+
+func (ls *LoyaltyServer) getHold(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, kindBadRequest, "Invalid hold ID")
+		return
+	}
+
+	hold, err := ls.order.GetHold(r.Context(), getUserID(r.Context()), id)
+	if err != nil {
+		writeError(w, r, "Failed to get hold", err)
+		return
+	}
+
+	writeHold(w, r, http.StatusOK, hold)
+}
+
+// captureHold withdraws the held points, the optional JSON body {"sum": n}
+// captures a part of them.
+func (ls *LoyaltyServer) captureHold(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, kindBadRequest, "Invalid hold ID")
+		return
+	}
+
+	var req struct {
+		Sum float64 `json:"sum"`
+	}
+	if r.ContentLength != 0 {
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to parse capture: %s", err)
+			writeProblem(w, r, kindBadRequest, msg)
+			return
+		}
+	}
+
+	hold, err := ls.order.CaptureHold(r.Context(), getUserID(r.Context()), id, req.Sum)
+	if err != nil {
+		writeError(w, r, "Failed to capture hold", err)
+		return
+	}
+
+	writeHold(w, r, http.StatusOK, hold)
+}
+
+func (ls *LoyaltyServer) releaseHold(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, kindBadRequest, "Invalid hold ID")
+		return
+	}
+
+	hold, err := ls.order.ReleaseHold(r.Context(), getUserID(r.Context()), id)
+	if err != nil {
+		writeError(w, r, "Failed to release hold", err)
+		return
+	}
+
+	writeHold(w, r, http.StatusOK, hold)
+}
+
+func writeHold(w http.ResponseWriter, r *http.Request, status int, hold storage.Hold) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(&hold)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
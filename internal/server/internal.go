@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+
+	"github.com/moorzeen/loyalty-service/internal/accrual"
+	"github.com/moorzeen/loyalty-service/internal/logging"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+const (
+	accrualTimestampHeader = "X-Accrual-Timestamp"
+	accrualSignatureHeader = "X-Accrual-Signature"
+	maxCallbackBody        = 1 << 20
+)
+
+// accrualCallback applies accrual results pushed by the accrual system.
+// The body is a single storage.Accrual object or an array of them.
+func (ls *LoyaltyServer) accrualCallback(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackBody))
+	if err != nil {
+		msg := fmt.Sprintf("Filed to read request body: %s", err)
+		writeProblem(w, r, kindBadRequest, msg)
+		return
+	}
+
+	err = accrual.VerifySignature([]byte(ls.AccrualCallbackSecret),
+		r.Header.Get(accrualTimestampHeader), r.Header.Get(accrualSignatureHeader), body)
+	if err != nil {
+		writeError(w, r, "Failed to verify callback", err)
+		return
+	}
+
+	var accruals []storage.Accrual
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(body, &accruals)
+	} else {
+		var single storage.Accrual
+		err = json.Unmarshal(body, &single)
+		accruals = append(accruals, single)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse accruals: %s", err)
+		writeProblem(w, r, kindBadRequest, msg)
+		return
+	}
+
+	type responseJSON struct {
+		Number string `json:"order"`
+		Result string `json:"result"`
+		Error  string `json:"error,omitempty"`
+	}
+	result := make([]responseJSON, 0, len(accruals))
+
+	for _, v := range accruals {
+		item := responseJSON{Number: v.OrderNumber}
+
+		ctx := logging.WithOrderNumber(r.Context(), v.OrderNumber)
+		changed, err := ls.accrual.Apply(ctx, v)
+		switch {
+		case errors.Is(err, accrual.ErrUnknownOrder):
+			item.Result, item.Error = "unknown", err.Error()
+		case errors.Is(err, accrual.ErrUnknownStatus):
+			item.Result, item.Error = "invalid", err.Error()
+		case err != nil:
+			writeError(w, r.WithContext(ctx), "Failed to apply accruals", err)
+			return
+		case changed:
+			item.Result = "applied"
+		default:
+			item.Result = "unchanged"
+		}
+
+		result = append(result, item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(&result)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
@@ -1,14 +1,22 @@
 package server
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
 
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/moorzeen/loyalty-service/internal/auth"
+	"github.com/moorzeen/loyalty-service/internal/idempotency"
+	"github.com/moorzeen/loyalty-service/internal/logging"
 )
 
 type ctxKey string
@@ -22,8 +30,7 @@ func RequestDecompress(next http.Handler) http.Handler {
 			r.Body, err = gzip.NewReader(r.Body)
 			if err != nil {
 				msg := fmt.Sprintf("Failed to decompress request: %s", err)
-				log.Println(msg)
-				http.Error(w, msg, http.StatusInternalServerError)
+				writeProblem(w, r, kindBadRequest, msg)
 				return
 			}
 		}
@@ -37,17 +44,48 @@ func Authentication(s auth.Service) func(http.Handler) http.Handler {
 		serveHTTP := func(w http.ResponseWriter, r *http.Request) {
 			userID, err := ra.validateCookie(r)
 			if err != nil {
-				log.Println(err)
-				http.Error(w, "Login to access this endpoint", http.StatusUnauthorized)
+				slog.WarnContext(r.Context(), "Authentication failed", "error", err)
+				writeProblem(w, r, kindUnauthorized, "Login to access this endpoint")
 				return
 			}
 			newContext := context.WithValue(r.Context(), UserIDContextKey, userID)
+			newContext = logging.WithUserID(newContext, userID)
 			next.ServeHTTP(w, r.WithContext(newContext))
 		}
 		return http.HandlerFunc(serveHTTP)
 	}
 }
 
+// AdminAuthentication allows requests with the "Authorization: Bearer <token>" header.
+func AdminAuthentication(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		serveHTTP := func(w http.ResponseWriter, r *http.Request) {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				slog.WarnContext(r.Context(), "Invalid admin token", "bearer", ok)
+				writeProblem(w, r, kindUnauthorized, "Admin token required to access this endpoint")
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(serveHTTP)
+	}
+}
+
+// RealIP replaces the remote address of a request from a trusted proxy with
+// the client address the proxy reports. X-Forwarded-For is read from the
+// right past the trusted hops, so addresses prepended by the client are
+// ignored. Headers of requests from other peers are never used.
+func RealIP(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		serveHTTP := func(w http.ResponseWriter, r *http.Request) {
+			r.RemoteAddr = clientIP(r, trusted)
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(serveHTTP)
+	}
+}
+
 type requestAuth struct {
 	auth auth.Service
 }
@@ -71,3 +109,88 @@ func (a *requestAuth) validateCookie(r *http.Request) (uint64, error) {
 
 	return userID, nil
 }
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+)
+
+// Idempotency replays the stored response to a retry of a request with the
+// same Idempotency-Key header. Requests without the header are served as is.
+// Server faults aren't stored, so the retry of a failed request runs again.
+func Idempotency(s idempotency.Service) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		serveHTTP := func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				msg := fmt.Sprintf("Filed to read request body: %s", err)
+				writeProblem(w, r, kindBadRequest, msg)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			userID := getUserID(r.Context())
+			hash := idempotency.Hash(r.Method, r.URL.Path, r.Header.Get("Content-Type"), body)
+
+			stored, err := s.Begin(r.Context(), userID, key, hash)
+			if err != nil {
+				writeError(w, r, "Failed to use the idempotency key", err)
+				return
+			}
+			if stored != nil {
+				if stored.ContentType != "" {
+					w.Header().Set("Content-Type", stored.ContentType)
+				}
+				w.Header().Set(idempotencyReplayedHeader, "true")
+				w.WriteHeader(stored.StatusCode)
+				_, err = w.Write(stored.Body)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed to replay response", "error", err)
+				}
+				return
+			}
+
+			// the client may be gone, the key has to be settled anyway
+			ctx := context.WithoutCancel(r.Context())
+
+			// a panicking handler leaves no response to store, the key is
+			// released while the panic goes on to the recoverer
+			settled := false
+			defer func() {
+				if settled {
+					return
+				}
+				if err := s.Release(ctx, userID, key); err != nil {
+					slog.ErrorContext(ctx, "Failed to release idempotency key", "error", err)
+				}
+			}()
+
+			var response bytes.Buffer
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ww.Tee(&response)
+
+			next.ServeHTTP(ww, r)
+
+			settled = true
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if status >= http.StatusInternalServerError {
+				err = s.Release(ctx, userID, key)
+			} else {
+				err = s.Complete(ctx, userID, key, status, w.Header().Get("Content-Type"), response.Bytes())
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to settle idempotency key", "error", err)
+			}
+		}
+		return http.HandlerFunc(serveHTTP)
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/idempotency"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+func TestAdminAuthentication(t *testing.T) {
+	h := AdminAuthentication("s3cret")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"Bearer s3cret", http.StatusNoContent},
+		{"s3cret", http.StatusUnauthorized},
+		{"Basic s3cret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/admin/campaigns", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("Authorization %q: status %d, want %d", tt.header, w.Code, tt.status)
+		}
+	}
+}
+
+// keyStorage keeps idempotency keys in memory.
+type keyStorage struct {
+	storage.Service
+	keys map[string]storage.IdempotencyKey
+}
+
+func (s *keyStorage) ClaimIdempotencyKey(_ context.Context, key storage.IdempotencyKey, expiredBefore, leasedBefore time.Time) (storage.IdempotencyKey, bool, error) {
+	stored, ok := s.keys[key.Key]
+	if ok && stored.CreatedAt.After(expiredBefore) && (stored.StatusCode != 0 || stored.CreatedAt.After(leasedBefore)) {
+		return stored, false, nil
+	}
+	key.CreatedAt = time.Now()
+	s.keys[key.Key] = key
+	return key, true, nil
+}
+
+func (s *keyStorage) SaveIdempotencyResponse(_ context.Context, key storage.IdempotencyKey) error {
+	stored := s.keys[key.Key]
+	stored.StatusCode, stored.ContentType, stored.Body = key.StatusCode, key.ContentType, key.Body
+	s.keys[key.Key] = stored
+	return nil
+}
+
+func (s *keyStorage) DeleteIdempotencyKey(_ context.Context, _ uint64, key string) error {
+	delete(s.keys, key)
+	return nil
+}
+
+func idempotentRequest(h http.Handler, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(`{"sum":10}`))
+	r.Header.Set(idempotencyKeyHeader, key)
+	r = r.WithContext(context.WithValue(r.Context(), UserIDContextKey, uint64(1)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	str := &keyStorage{keys: map[string]storage.IdempotencyKey{}}
+	calls := 0
+	h := Idempotency(idempotency.NewService(str, time.Hour))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+
+	first := idempotentRequest(h, "k1")
+	retry := idempotentRequest(h, "k1")
+
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+	if retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() {
+		t.Errorf("replayed %d %q, want %d %q", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	if retry.Header().Get(idempotencyReplayedHeader) != "true" {
+		t.Error("replayed response is not marked")
+	}
+}
+
+func TestIdempotencyPanic(t *testing.T) {
+	str := &keyStorage{keys: map[string]storage.IdempotencyKey{}}
+	h := Idempotency(idempotency.NewService(str, time.Hour))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	}))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic is not propagated")
+			}
+		}()
+		idempotentRequest(h, "k1")
+	}()
+
+	if _, ok := str.keys["k1"]; ok {
+		t.Error("key of a panicked request is still claimed")
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	str := &keyStorage{keys: map[string]storage.IdempotencyKey{}}
+	h := Idempotency(idempotency.NewService(str, time.Hour))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// a claim of a crashed request, still within the lease and past it
+	hash := idempotency.Hash(http.MethodPost, "/api/user/balance/withdraw", "", []byte(`{"sum":10}`))
+	str.keys["k1"] = storage.IdempotencyKey{UserID: 1, Key: "k1", RequestHash: hash, CreatedAt: time.Now()}
+	str.keys["k2"] = storage.IdempotencyKey{UserID: 1, Key: "k2", RequestHash: hash, CreatedAt: time.Now().Add(-time.Hour / 2)}
+
+	if w := idempotentRequest(h, "k1"); w.Code != http.StatusConflict {
+		t.Errorf("leased key: status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := idempotentRequest(h, "k2"); w.Code != http.StatusOK {
+		t.Errorf("abandoned key: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	h := RealIP(proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.RemoteAddr
+	}))
+
+	tests := []struct {
+		name   string
+		peer   string
+		xff    string
+		realIP string
+		want   string
+	}{
+		{"direct client", "203.0.113.5:4000", "", "", "203.0.113.5"},
+		{"spoofed header", "203.0.113.5:4000", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:4000", "198.51.100.1", "", "198.51.100.1"},
+		{"client prepended address", "10.1.2.3:4000", "1.1.1.1, 198.51.100.1", "", "198.51.100.1"},
+		{"proxy chain", "192.0.2.1:4000", "198.51.100.1, 10.9.9.9", "", "198.51.100.1"},
+		{"real ip of trusted proxy", "10.1.2.3:4000", "", "198.51.100.1", "198.51.100.1"},
+		{"malformed hop", "10.1.2.3:4000", "unknown", "", "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/user/register", nil)
+		r.RemoteAddr = tt.peer
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, v := range []string{"", "10.0.0.0/8", "192.0.2.1, ::1", "fd00::/8"} {
+		if _, err := parseTrustedProxies(v); err != nil {
+			t.Errorf("parseTrustedProxies(%q): %v", v, err)
+		}
+	}
+	for _, v := range []string{"proxy", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies(v); err == nil {
+			t.Errorf("parseTrustedProxies(%q) accepted", v)
+		}
+	}
+}
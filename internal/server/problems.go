@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/moorzeen/loyalty-service/internal/accrual"
+	"github.com/moorzeen/loyalty-service/internal/auth"
+	"github.com/moorzeen/loyalty-service/internal/campaign"
+	"github.com/moorzeen/loyalty-service/internal/idempotency"
+	"github.com/moorzeen/loyalty-service/internal/order"
+	"github.com/moorzeen/loyalty-service/internal/referral"
+	"github.com/moorzeen/loyalty-service/internal/webhook"
+)
+
+const problemContentType = "application/problem+json"
+
+// errorKind is the stable code, HTTP status and title of a class of errors.
+// Clients branch on the code, the title and the status never change for it.
+type errorKind struct {
+	Code   string
+	Status int
+	Title  string
+}
+
+var (
+	kindBadRequest             = errorKind{"bad_request", http.StatusBadRequest, "Bad request"}
+	kindUnsupportedContentType = errorKind{"unsupported_content_type", http.StatusBadRequest, "Unsupported content type"}
+	kindUnauthorized           = errorKind{"unauthorized", http.StatusUnauthorized, "Authentication required"}
+	kindInternal               = errorKind{"internal_error", http.StatusInternalServerError, "Internal server error"}
+)
+
+// errorRegistry maps domain errors to their kinds. Errors missing here are internal.
+var errorRegistry = []struct {
+	err  error
+	kind errorKind
+}{
+	{auth.ErrShortPassword, errorKind{"short_password", http.StatusBadRequest, "Password is too short"}},
+	{auth.ErrUsernameTaken, errorKind{"login_taken", http.StatusConflict, "Login is already taken"}},
+	{auth.ErrInvalidUser, errorKind{"invalid_credentials", http.StatusUnauthorized, "Invalid login or password"}},
+	{auth.ErrNoUser, errorKind{"invalid_credentials", http.StatusUnauthorized, "Invalid login or password"}},
+	{auth.ErrWrongPassword, errorKind{"invalid_credentials", http.StatusUnauthorized, "Invalid login or password"}},
+	{auth.ErrInvalidAuthToken, errorKind{"invalid_auth_token", http.StatusUnauthorized, "Invalid authorization token"}},
+	{referral.ErrInvalidReferralCode, errorKind{"invalid_referral_code", http.StatusBadRequest, "Invalid referral code"}},
+
+	{order.ErrAddedByOther, errorKind{"order_owned_by_other", http.StatusConflict, "Order is added by another user"}},
+	{order.ErrInvalidOrderNumber, errorKind{"invalid_order_number", http.StatusUnprocessableEntity, "Invalid order number"}},
+	{order.ErrOrderNotFound, errorKind{"order_not_found", http.StatusNotFound, "Order not found"}},
+	{order.ErrInsufficientFunds, errorKind{"insufficient_funds", http.StatusPaymentRequired, "Insufficient funds"}},
+	{order.ErrEmptyBatch, errorKind{"empty_batch", http.StatusBadRequest, "Empty order batch"}},
+	{order.ErrBatchTooLarge, errorKind{"batch_too_large", http.StatusRequestEntityTooLarge, "Order batch is too large"}},
+	{order.ErrInvalidCursor, errorKind{"invalid_cursor", http.StatusBadRequest, "Invalid page cursor"}},
+	{order.ErrInvalidFilter, errorKind{"invalid_filter", http.StatusBadRequest, "Invalid history filter"}},
+	{order.ErrAlreadyWithdrawn, errorKind{"already_withdrawn", http.StatusConflict, "Order is already paid with points"}},
+	{order.ErrInvalidSum, errorKind{"invalid_sum", http.StatusBadRequest, "Invalid sum"}},
+	{order.ErrInvalidHoldTTL, errorKind{"invalid_hold_ttl", http.StatusBadRequest, "Invalid hold TTL"}},
+	{order.ErrHoldNotFound, errorKind{"hold_not_found", http.StatusNotFound, "Hold not found"}},
+	{order.ErrHoldNotActive, errorKind{"hold_not_active", http.StatusConflict, "Hold is already settled"}},
+	{order.ErrHoldExpired, errorKind{"hold_expired", http.StatusConflict, "Hold is expired"}},
+	{order.ErrCaptureTooLarge, errorKind{"capture_too_large", http.StatusUnprocessableEntity, "Capture exceeds the hold"}},
+	{order.ErrWithdrawalNotFound, errorKind{"withdrawal_not_found", http.StatusNotFound, "Withdrawal not found"}},
+	{order.ErrInvalidReversal, errorKind{"invalid_reversal", http.StatusBadRequest, "Invalid reversal sum"}},
+	{order.ErrReversalTooLarge, errorKind{"reversal_too_large", http.StatusUnprocessableEntity, "Reversal exceeds the withdrawal"}},
+	{order.ErrAlreadyReversed, errorKind{"already_reversed", http.StatusConflict, "Withdrawal is already reversed"}},
+	{order.ErrRecipientNotFound, errorKind{"recipient_not_found", http.StatusNotFound, "Recipient not found"}},
+	{order.ErrSelfTransfer, errorKind{"self_transfer", http.StatusBadRequest, "Transfer to yourself"}},
+	{order.ErrTransferLimit, errorKind{"transfer_limit_exceeded", http.StatusUnprocessableEntity, "Daily transfer limit exceeded"}},
+	{order.ErrInvalidLimits, errorKind{"invalid_transfer_limits", http.StatusBadRequest, "Invalid transfer limits"}},
+
+	{webhook.ErrWebhookNotFound, errorKind{"webhook_not_found", http.StatusNotFound, "Webhook not found"}},
+	{webhook.ErrInvalidURL, errorKind{"invalid_webhook_url", http.StatusBadRequest, "Invalid webhook URL"}},
+	{webhook.ErrPrivateAddress, errorKind{"private_webhook_address", http.StatusBadRequest, "Webhook URL is not public"}},
+	{webhook.ErrNoEventTypes, errorKind{"no_event_types", http.StatusBadRequest, "No webhook event types"}},
+	{webhook.ErrUnknownEventType, errorKind{"unknown_event_type", http.StatusBadRequest, "Unknown webhook event type"}},
+
+	{idempotency.ErrInvalidKey, errorKind{"invalid_idempotency_key", http.StatusBadRequest, "Invalid idempotency key"}},
+	{idempotency.ErrKeyReused, errorKind{"idempotency_key_reused", http.StatusUnprocessableEntity, "Idempotency key is reused"}},
+	{idempotency.ErrInProgress, errorKind{"idempotent_request_in_progress", http.StatusConflict, "Request is in progress"}},
+
+	{accrual.ErrBadSignature, errorKind{"invalid_signature", http.StatusUnauthorized, "Invalid callback signature"}},
+	{accrual.ErrInvalidRule, errorKind{"invalid_accrual_rule", http.StatusBadRequest, "Invalid accrual rule"}},
+	{accrual.ErrRuleNotFound, errorKind{"accrual_rule_not_found", http.StatusNotFound, "Accrual rule not found"}},
+
+	{campaign.ErrInvalidCampaign, errorKind{"invalid_campaign", http.StatusBadRequest, "Invalid campaign"}},
+	{campaign.ErrCampaignNotFound, errorKind{"campaign_not_found", http.StatusNotFound, "Campaign not found"}},
+}
+
+// problem is an RFC 7807 error response.
+type problem struct {
+	Type          string `json:"type"`
+	Title         string `json:"title"`
+	Status        int    `json:"status"`
+	Code          string `json:"code"`
+	Detail        string `json:"detail,omitempty"`
+	Instance      string `json:"instance,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+func errorKindOf(err error) errorKind {
+	for _, e := range errorRegistry {
+		if errors.Is(err, e.err) {
+			return e.kind
+		}
+	}
+	return kindInternal
+}
+
+// writeError responds with the problem of err, detailed by msg and the error text.
+func writeError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	writeProblem(w, r, errorKindOf(err), msg+": "+err.Error())
+}
+
+// writeProblem logs and responds with the problem of kind. The detail of
+// server faults is only logged: the client gets the correlation ID of the
+// log line instead, so internal errors never leak.
+func writeProblem(w http.ResponseWriter, r *http.Request, kind errorKind, detail string) {
+	p := problem{
+		Type:     "/errors/" + kind.Code,
+		Title:    kind.Title,
+		Status:   kind.Status,
+		Code:     kind.Code,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+
+	if kind.Status >= http.StatusInternalServerError {
+		p.Detail = ""
+		p.CorrelationID = correlationID(r)
+		slog.ErrorContext(r.Context(), detail, "code", kind.Code, "correlation_id", p.CorrelationID)
+	} else {
+		slog.WarnContext(r.Context(), detail, "code", kind.Code)
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(kind.Status)
+	err := json.NewEncoder(w).Encode(&p)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode problem", "error", err)
+	}
+}
+
+// correlationID is the request ID, the one found in the request log lines.
+func correlationID(r *http.Request) string {
+	if id := middleware.GetReqID(r.Context()); id != "" {
+		return id
+	}
+
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
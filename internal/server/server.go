@@ -2,25 +2,55 @@ package server
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/moorzeen/loyalty-service/internal/accrual"
 	"github.com/moorzeen/loyalty-service/internal/auth"
+	"github.com/moorzeen/loyalty-service/internal/campaign"
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/idempotency"
+	"github.com/moorzeen/loyalty-service/internal/logging"
+	"github.com/moorzeen/loyalty-service/internal/metrics"
 	"github.com/moorzeen/loyalty-service/internal/order"
+	"github.com/moorzeen/loyalty-service/internal/outbox"
+	"github.com/moorzeen/loyalty-service/internal/points"
+	"github.com/moorzeen/loyalty-service/internal/referral"
 	"github.com/moorzeen/loyalty-service/internal/storage"
 	"github.com/moorzeen/loyalty-service/internal/storage/postgres"
+	"github.com/moorzeen/loyalty-service/internal/tier"
+	"github.com/moorzeen/loyalty-service/internal/tracing"
+	"github.com/moorzeen/loyalty-service/internal/webhook"
 )
 
 type LoyaltyServer struct {
 	config
-	storage storage.Service
-	auth    auth.Service
-	order   order.Service
-	accrual accrual.Service
-	Router  *chi.Mux
+	storage  storage.Service
+	auth     auth.Service
+	order    order.Service
+	accrual  accrual.Service
+	rules    *accrual.RulesEngine
+	provider *accrual.Router
+	webhook  webhook.Service
+	idem     idempotency.Service
+	expirer  points.Expirer
+	tier     tier.Service
+	campaign campaign.Service
+	referral referral.Service
+	outbox   outbox.Relay
+	purger   outbox.Purger
+	events   *events.Hub
+	Router   *chi.Mux
+
+	// schemaVersion is the migration version the storage must be at
+	schemaVersion uint
+	// proxies are the networks of the trusted reverse proxies
+	proxies []*net.IPNet
 }
 
 func NewServer(cfg *config) (*LoyaltyServer, error) {
@@ -35,10 +65,75 @@ func NewServer(cfg *config) (*LoyaltyServer, error) {
 		return nil, err
 	}
 
-	ls.auth = auth.NewService(ls.storage)
-	ls.order = order.NewService(ls.storage)
-	client := accrual.NewClient(ls.AccrualAddress)
-	ls.accrual = accrual.NewService(ls.storage, client)
+	ls.schemaVersion, err = postgres.LatestMigration()
+	if err != nil {
+		return nil, err
+	}
+
+	ls.proxies, err = parseTrustedProxies(ls.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	ls.events = events.NewHub()
+	bridge, err := postgres.NewBridge(ctx, cfg.DatabaseURI, ls.events)
+	if err != nil {
+		return nil, err
+	}
+
+	ls.webhook = webhook.NewService(ls.storage)
+	publisher := events.Publishers{bridge}
+
+	pub, err := outbox.NewPublisher(cfg.OutboxPublisher)
+	if err != nil {
+		return nil, err
+	}
+	if pub != nil {
+		ls.outbox = outbox.NewRelay(ls.storage, pub)
+	}
+	ls.purger = outbox.NewPurger(ls.storage, pub == nil)
+
+	ls.idem = idempotency.NewService(ls.storage, ls.IdempotencyTTL)
+	expiry := points.Policy{Months: ls.PointsExpiryMonths}
+	ls.expirer = points.NewExpirer(ls.storage, publisher)
+	ls.referral = referral.NewService(ls.storage, referral.Config{
+		ReferrerBonus: ls.ReferrerBonus,
+		ReferredBonus: ls.ReferredBonus,
+		MaxRewarded:   ls.ReferralCap,
+	})
+	ls.auth = auth.NewService(ls.storage, &ls.referral)
+	ls.order = order.NewService(ls.storage, publisher, ls.HoldTTL, expiry)
+	ls.rules, err = accrual.NewRulesEngine(ls.storage, ls.AccrualRulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ls.provider, err = accrual.NewProvider(accrual.ProviderConfig{
+		DefaultAddress:   ls.AccrualAddress,
+		Providers:        ls.AccrualProviders,
+		Routes:           ls.AccrualRoutes,
+		Rules:            ls.rules,
+		BreakerThreshold: ls.AccrualBreakerThreshold,
+		BreakerCoolDown:  ls.AccrualBreakerCoolDown,
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics.Registry.MustRegister(ls.provider)
+
+	grace := time.Duration(0)
+	if ls.AccrualCallbackSecret != "" {
+		grace = ls.AccrualCallbackGrace
+	}
+	tiers, err := tier.ParseTiers(ls.Tiers)
+	if err != nil {
+		return nil, err
+	}
+	ls.tier = tier.NewService(ls.storage, tiers, ls.TierWindow)
+
+	ls.campaign = campaign.NewService(ls.storage)
+
+	ls.accrual = accrual.NewService(ls.storage, ls.provider, publisher, grace, expiry, &ls.tier, &ls.campaign, &ls.referral)
 	ls.Router = newRouter(ls)
 
 	return ls, nil
@@ -48,7 +143,8 @@ func (ls *LoyaltyServer) Run() {
 	go func() {
 		err := http.ListenAndServe(ls.RunAddress, ls.Router)
 		if err != nil {
-			log.Fatalf("Server error: %s", err)
+			slog.Error("Server error", "error", err)
+			os.Exit(1)
 		}
 	}()
 }
@@ -56,22 +152,64 @@ func (ls *LoyaltyServer) Run() {
 func newRouter(ls *LoyaltyServer) *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(tracing.Middleware)
+	r.Use(metrics.Middleware)
+	r.Use(RealIP(ls.proxies))
+	r.Use(logging.Middleware)
 	r.Use(middleware.Recoverer)
 	r.Use(RequestDecompress)
 	r.Use(middleware.Compress(5))
+	r.Handle("/metrics", metrics.Handler())
+	r.Get("/healthz", ls.liveness)
+	r.Get("/readyz", ls.readiness)
 	r.Post("/api/user/register", ls.register)
 	r.Post("/api/user/login", ls.login)
 
+	// accrual system callbacks, authenticated by a shared secret signature
+	if ls.AccrualCallbackSecret != "" {
+		r.Post("/api/internal/accruals", ls.accrualCallback)
+	}
+
+	// administration handlers, authorized by the admin token
+	if ls.AdminToken != "" {
+		r.Route("/api/admin", func(r chi.Router) {
+			r.Use(AdminAuthentication(ls.AdminToken))
+			r.Post("/accrual/orders", ls.addAccrualOrder)
+			r.Get("/accrual/rules", ls.getAccrualRules)
+			r.Post("/accrual/rules", ls.addAccrualRule)
+			r.Delete("/accrual/rules/{id}", ls.deleteAccrualRule)
+			r.Post("/withdrawals/{number}/reversals", ls.reverseWithdrawal)
+			r.Get("/campaigns", ls.getCampaigns)
+			r.Post("/campaigns", ls.addCampaign)
+			r.Delete("/campaigns/{id}", ls.endCampaign)
+			r.Get("/transfers/limits", ls.getTransferLimits)
+			r.Put("/transfers/limits", ls.setTransferLimits)
+		})
+	}
+
 	// authorization required handlers
 	r.Group(func(r chi.Router) {
 		r.Use(Authentication(ls.auth))
-		r.Post("/api/user/orders", ls.newOrder)
+		r.With(Idempotency(ls.idem)).Post("/api/user/orders", ls.newOrder)
+		r.With(Idempotency(ls.idem)).Post("/api/user/orders/batch", ls.newOrders)
 		r.Get("/api/user/orders", ls.getOrders)
+		r.Get("/api/user/orders/stream", ls.streamOrders)
+		r.Get("/api/user/orders/{number}", ls.getOrder)
 		r.Get("/api/user/balance", ls.getBalance)
-		r.Post("/api/user/balance/withdraw", ls.withdraw)
+		r.With(Idempotency(ls.idem)).Post("/api/user/balance/withdraw", ls.withdraw)
 		r.Get("/api/user/withdrawals", ls.getWithdrawals)
+		r.With(Idempotency(ls.idem)).Post("/api/user/balance/transfer", ls.transfer)
+		r.Get("/api/user/transfers", ls.getTransfers)
+		r.Get("/api/user/tier/history", ls.getTierHistory)
+		r.Get("/api/user/referrals", ls.getReferrals)
+		r.With(Idempotency(ls.idem)).Post("/api/user/balance/holds", ls.addHold)
+		r.Get("/api/user/balance/holds/{id}", ls.getHold)
+		r.With(Idempotency(ls.idem)).Post("/api/user/balance/holds/{id}/capture", ls.captureHold)
+		r.Post("/api/user/balance/holds/{id}/release", ls.releaseHold)
+		r.Post("/api/user/webhooks", ls.addWebhook)
+		r.Get("/api/user/webhooks", ls.getWebhooks)
+		r.Delete("/api/user/webhooks/{id}", ls.deleteWebhook)
+		r.Get("/api/user/webhooks/{id}/deliveries", ls.getWebhookDeliveries)
 
 	})
 	return r
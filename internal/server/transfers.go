@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/moorzeen/loyalty-service/internal/order"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+func (ls *LoyaltyServer) transfer(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
+		return
+	}
+
+	req := order.TransferRequest{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse transfer: %s", err)
+		writeProblem(w, r, kindBadRequest, msg)
+		return
+	}
+
+	req.UserID = getUserID(r.Context())
+
+	t, err := ls.order.Transfer(r.Context(), req)
+	if err != nil {
+		writeError(w, r, "Failed to transfer", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(&t)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) getTransfers(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+
+	opts, err := parseHistoryOptions(r)
+	if err != nil {
+		writeError(w, r, "Failed to get transfers", err)
+		return
+	}
+
+	transfers, next, err := ls.order.GetTransfers(r.Context(), userID, opts)
+	if err != nil {
+		writeError(w, r, "Failed to get transfers", err)
+		return
+	}
+
+	if len(transfers) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	setNextLink(w, r, next)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(&transfers)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) getTransferLimits(w http.ResponseWriter, r *http.Request) {
+	limits, err := ls.order.GetTransferLimits(r.Context())
+	if err != nil {
+		writeError(w, r, "Failed to get transfer limits", err)
+		return
+	}
+
+	writeTransferLimits(w, r, limits)
+}
+
+func (ls *LoyaltyServer) setTransferLimits(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
+		return
+	}
+
+	req := storage.TransferLimits{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse transfer limits: %s", err)
+		writeProblem(w, r, kindBadRequest, msg)
+		return
+	}
+
+	limits, err := ls.order.SetTransferLimits(r.Context(), req)
+	if err != nil {
+		writeError(w, r, "Failed to set transfer limits", err)
+		return
+	}
+
+	writeTransferLimits(w, r, limits)
+}
+
+func writeTransferLimits(w http.ResponseWriter, r *http.Request, limits storage.TransferLimits) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(&limits)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
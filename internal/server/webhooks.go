@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/moorzeen/loyalty-service/internal/webhook"
+)
+
+func (ls *LoyaltyServer) addWebhook(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		msg := fmt.Sprintf("Unsupported content type \"%s\"", contentType)
+		writeProblem(w, r, kindUnsupportedContentType, msg)
+		return
+	}
+
+	req := webhook.Webhook{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to parse webhook: %s", err)
+		writeProblem(w, r, kindBadRequest, msg)
+		return
+	}
+
+	userID := getUserID(r.Context())
+
+	hook, err := ls.webhook.Register(r.Context(), userID, req.URL, req.EventTypes)
+	if err != nil {
+		writeError(w, r, "Failed to add webhook", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(hook)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+
+	hooks, err := ls.webhook.List(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, "Failed to get webhooks", err)
+		return
+	}
+
+	if len(hooks) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(&hooks)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+func (ls *LoyaltyServer) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, kindBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	err = ls.webhook.Delete(r.Context(), userID, id)
+	if err != nil {
+		writeError(w, r, "Failed to delete webhook", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ls *LoyaltyServer) getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r.Context())
+
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, kindBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	deliveries, err := ls.webhook.Deliveries(r.Context(), userID, id)
+	if err != nil {
+		writeError(w, r, "Failed to get webhook deliveries", err)
+		return
+	}
+
+	if len(deliveries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(&deliveries)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
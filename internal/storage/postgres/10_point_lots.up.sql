@@ -0,0 +1,36 @@
+create table POINT_LOTS
+(
+    ID bigserial primary key,
+    USER_ID bigint not null references USERS (ID),
+    KIND text not null,
+    ORDER_NUMBER text not null default '',
+    AMOUNT numeric not null check (AMOUNT > 0),
+    REMAINING numeric not null check (REMAINING >= 0 and REMAINING <= AMOUNT),
+    EXPIRES_AT timestamptz,
+    CREATED_AT timestamptz not null default current_timestamp
+);
+
+-- consumeLots, GetExpirations
+create index POINT_LOTS_USER_ID_OPEN_IDX on POINT_LOTS (USER_ID, ID) where REMAINING > 0;
+-- ExpirePoints
+create index POINT_LOTS_EXPIRES_AT_OPEN_IDX on POINT_LOTS (EXPIRES_AT) where REMAINING > 0;
+
+create table POINT_LEDGER
+(
+    ID bigserial primary key,
+    USER_ID bigint not null references USERS (ID),
+    LOT_ID bigint not null references POINT_LOTS (ID),
+    KIND text not null check (KIND in ('MIGRATION', 'ACCRUAL', 'REVERSAL', 'WITHDRAWAL', 'EXPIRY')),
+    AMOUNT numeric not null,
+    ORDER_NUMBER text not null default '',
+    CREATED_AT timestamptz not null default current_timestamp
+);
+
+create index POINT_LEDGER_USER_ID_CREATED_AT_IDX on POINT_LEDGER (USER_ID, CREATED_AT);
+
+-- the current balances become lots that never expire
+insert into POINT_LOTS (USER_ID, KIND, AMOUNT, REMAINING)
+select USER_ID, 'MIGRATION', BALANCE, BALANCE from ACCOUNTS where BALANCE > 0;
+
+insert into POINT_LEDGER (USER_ID, LOT_ID, KIND, AMOUNT)
+select USER_ID, ID, KIND, AMOUNT from POINT_LOTS;
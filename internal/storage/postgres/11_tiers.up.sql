@@ -0,0 +1,29 @@
+create table USER_TIERS
+(
+    USER_ID bigint primary key references USERS (ID),
+    TIER text not null,
+    POINTS numeric not null default 0,
+    ORDERS integer not null default 0,
+    UPDATED_AT timestamptz not null default current_timestamp
+);
+
+create table TIER_HISTORY
+(
+    ID bigserial primary key,
+    USER_ID bigint not null references USERS (ID),
+    TIER text not null,
+    PREVIOUS_TIER text not null default '',
+    POINTS numeric not null default 0,
+    ORDERS integer not null default 0,
+    CHANGED_AT timestamptz not null default current_timestamp
+);
+
+create index TIER_HISTORY_USER_ID_CHANGED_AT_IDX on TIER_HISTORY (USER_ID, CHANGED_AT);
+
+-- GetTierStats
+create index POINT_LEDGER_KIND_CREATED_AT_IDX on POINT_LEDGER (KIND, CREATED_AT);
+create index ORDER_EVENTS_STATUS_CREATED_AT_IDX on ORDER_EVENTS (STATUS, CREATED_AT);
+
+alter table POINT_LEDGER drop constraint POINT_LEDGER_KIND_CHECK;
+alter table POINT_LEDGER add constraint POINT_LEDGER_KIND_CHECK
+    check (KIND in ('MIGRATION', 'ACCRUAL', 'REVERSAL', 'WITHDRAWAL', 'EXPIRY', 'TIER_BONUS'));
@@ -0,0 +1,27 @@
+-- existing users are counted as registered at the migration
+alter table USERS add column CREATED_AT timestamptz not null default current_timestamp;
+
+create table CAMPAIGNS
+(
+    ID bigserial primary key,
+    NAME text not null,
+    STARTS_AT timestamptz not null,
+    ENDS_AT timestamptz not null,
+    NEW_USER_DAYS integer not null default 0,
+    TIERS text[] not null default '{}',
+    MIN_ORDERS integer not null default 0,
+    MAX_ORDERS integer not null default 0,
+    EFFECT text not null check (EFFECT in ('multiplier', 'fixed')),
+    VALUE numeric not null,
+    CREATED_AT timestamptz not null default current_timestamp,
+    check (ENDS_AT > STARTS_AT)
+);
+
+create index CAMPAIGNS_ENDS_AT_IDX on CAMPAIGNS (ENDS_AT);
+
+alter table POINT_LEDGER add column CAMPAIGN_ID bigint references CAMPAIGNS (ID);
+create index POINT_LEDGER_CAMPAIGN_ID_IDX on POINT_LEDGER (CAMPAIGN_ID) where CAMPAIGN_ID is not null;
+
+alter table POINT_LEDGER drop constraint POINT_LEDGER_KIND_CHECK;
+alter table POINT_LEDGER add constraint POINT_LEDGER_KIND_CHECK
+    check (KIND in ('MIGRATION', 'ACCRUAL', 'REVERSAL', 'WITHDRAWAL', 'EXPIRY', 'TIER_BONUS', 'CAMPAIGN'));
@@ -0,0 +1,44 @@
+alter table USERS add column REFERRAL_CODE text unique;
+alter table USERS add column SIGNUP_IP text not null default '';
+alter table USERS add column SIGNUP_DEVICE text not null default '';
+
+-- codes of the existing users are drawn from the alphabet of referral.generateCode,
+-- a taken code is drawn again
+do $$
+declare
+    U record;
+begin
+    for U in select ID from USERS loop
+        loop
+            begin
+                update USERS set REFERRAL_CODE = (
+                    select string_agg(substr('ABCDEFGHJKLMNPQRSTUVWXYZ23456789', 1 + floor(random() * 32)::int, 1), '')
+                    from generate_series(1, 8)
+                ) where ID = U.ID;
+                exit;
+            exception when unique_violation then
+                null;
+            end;
+        end loop;
+    end loop;
+end
+$$;
+
+create table REFERRALS
+(
+    REFERRED_ID bigint primary key references USERS (ID),
+    REFERRER_ID bigint not null references USERS (ID),
+    STATUS text not null default 'PENDING' check (STATUS in ('PENDING', 'REWARDED', 'REJECTED')),
+    REASON text not null default '',
+    REFERRER_BONUS numeric not null default 0,
+    REFERRED_BONUS numeric not null default 0,
+    CREATED_AT timestamptz not null default current_timestamp,
+    REWARDED_AT timestamptz,
+    check (REFERRER_ID <> REFERRED_ID)
+);
+
+create index REFERRALS_REFERRER_ID_IDX on REFERRALS (REFERRER_ID, CREATED_AT);
+
+alter table POINT_LEDGER drop constraint POINT_LEDGER_KIND_CHECK;
+alter table POINT_LEDGER add constraint POINT_LEDGER_KIND_CHECK
+    check (KIND in ('MIGRATION', 'ACCRUAL', 'REVERSAL', 'WITHDRAWAL', 'EXPIRY', 'TIER_BONUS', 'CAMPAIGN', 'REFERRAL'));
@@ -0,0 +1,28 @@
+create table TRANSFERS
+(
+    ID bigserial primary key,
+    SENDER_ID bigint not null references USERS (ID),
+    RECIPIENT_ID bigint not null references USERS (ID),
+    SUM numeric not null check (SUM > 0),
+    CREATED_AT timestamptz not null default current_timestamp,
+    check (SENDER_ID <> RECIPIENT_ID)
+);
+
+create index TRANSFERS_SENDER_ID_CREATED_AT_IDX on TRANSFERS (SENDER_ID, CREATED_AT);
+create index TRANSFERS_RECIPIENT_ID_CREATED_AT_IDX on TRANSFERS (RECIPIENT_ID, CREATED_AT);
+
+-- a single row, zero limits are not enforced
+create table TRANSFER_LIMITS
+(
+    ID boolean primary key default true check (ID),
+    DAILY_SUM numeric not null default 0 check (DAILY_SUM >= 0),
+    DAILY_COUNT integer not null default 0 check (DAILY_COUNT >= 0),
+    UPDATED_AT timestamptz not null default current_timestamp
+);
+
+insert into TRANSFER_LIMITS default values;
+
+alter table POINT_LEDGER drop constraint POINT_LEDGER_KIND_CHECK;
+alter table POINT_LEDGER add constraint POINT_LEDGER_KIND_CHECK
+    check (KIND in ('MIGRATION', 'ACCRUAL', 'REVERSAL', 'WITHDRAWAL', 'EXPIRY', 'TIER_BONUS', 'CAMPAIGN', 'REFERRAL',
+                    'TRANSFER_OUT', 'TRANSFER_IN'));
@@ -0,0 +1,2 @@
+-- webhook deliveries are fanned out of the outbox in the transaction writing it
+alter table WEBHOOK_OUTBOX add column OUTBOX_ID bigint references OUTBOX (ID) on delete set null;
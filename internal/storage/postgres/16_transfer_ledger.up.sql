@@ -0,0 +1,2 @@
+-- ledger entries of a transfer refer to it, the received lots keep the expiry of the sent ones
+alter table POINT_LEDGER add column TRANSFER_ID bigint references TRANSFERS (ID);
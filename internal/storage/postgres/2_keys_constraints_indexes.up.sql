@@ -0,0 +1,45 @@
+-- foreign keys were declared as bigserial, drop the sequences they created
+alter table SESSIONS alter column USER_ID drop default;
+alter table ORDERS alter column USER_ID drop default;
+alter table ACCOUNTS alter column USER_ID drop default;
+alter table WITHDRAWALS alter column USER_ID drop default;
+
+drop sequence if exists SESSIONS_USER_ID_SEQ;
+drop sequence if exists ORDERS_USER_ID_SEQ;
+drop sequence if exists ACCOUNTS_USER_ID_SEQ;
+drop sequence if exists WITHDRAWALS_USER_ID_SEQ;
+
+-- primary keys replace the plain unique constraints
+alter table SESSIONS add primary key (USER_ID);
+alter table SESSIONS drop constraint if exists SESSIONS_USER_ID_KEY;
+
+alter table ACCOUNTS add primary key (USER_ID);
+alter table ACCOUNTS drop constraint if exists ACCOUNTS_USER_ID_KEY;
+
+alter table WITHDRAWALS add primary key (ORDER_NUMBER);
+alter table WITHDRAWALS drop constraint if exists WITHDRAWALS_ORDER_NUMBER_KEY;
+
+-- amounts are never null or negative
+update ORDERS set ACCRUAL = 0 where ACCRUAL is null;
+alter table ORDERS alter column ACCRUAL set not null;
+alter table ORDERS add constraint ORDERS_ACCRUAL_CHECK check (ACCRUAL >= 0);
+alter table ORDERS add constraint ORDERS_STATUS_CHECK
+    check (STATUS in ('NEW', 'REGISTERED', 'PROCESSING', 'INVALID', 'PROCESSED'));
+
+update ACCOUNTS set BALANCE = 0 where BALANCE is null;
+update ACCOUNTS set WITHDRAWN = 0 where WITHDRAWN is null;
+alter table ACCOUNTS alter column BALANCE set not null;
+alter table ACCOUNTS alter column WITHDRAWN set not null;
+alter table ACCOUNTS add constraint ACCOUNTS_BALANCE_CHECK check (BALANCE >= 0);
+alter table ACCOUNTS add constraint ACCOUNTS_WITHDRAWN_CHECK check (WITHDRAWN >= 0);
+
+update WITHDRAWALS set SUM = 0 where SUM is null;
+alter table WITHDRAWALS alter column SUM set not null;
+alter table WITHDRAWALS add constraint WITHDRAWALS_SUM_CHECK check (SUM >= 0);
+
+-- GetOrders
+create index ORDERS_USER_ID_UPLOADED_AT_IDX on ORDERS (USER_ID, UPLOADED_AT);
+-- GetNewOrders, GetProcessingOrders
+create index ORDERS_STATUS_IDX on ORDERS (STATUS) where STATUS in ('NEW', 'PROCESSING');
+-- GetWithdrawals
+create index WITHDRAWALS_USER_ID_PROCESSED_AT_IDX on WITHDRAWALS (USER_ID, PROCESSED_AT);
@@ -0,0 +1,10 @@
+create table ORDER_EVENTS
+(
+    ID bigserial primary key,
+    ORDER_NUMBER text not null references ORDERS (ORDER_NUMBER),
+    STATUS text not null,
+    ACCRUAL numeric not null default 0,
+    CREATED_AT timestamptz not null default current_timestamp
+);
+
+create index ORDER_EVENTS_ORDER_NUMBER_IDX on ORDER_EVENTS (ORDER_NUMBER, CREATED_AT);
@@ -0,0 +1,37 @@
+create table WEBHOOKS
+(
+    ID bigserial primary key,
+    USER_ID bigint not null references USERS (ID),
+    URL text not null,
+    SECRET bytea not null,
+    EVENT_TYPES text[] not null,
+    CREATED_AT timestamptz not null default current_timestamp
+);
+
+create index WEBHOOKS_USER_ID_IDX on WEBHOOKS (USER_ID);
+
+create table WEBHOOK_OUTBOX
+(
+    ID bigserial primary key,
+    WEBHOOK_ID bigint not null references WEBHOOKS (ID) on delete cascade,
+    EVENT_TYPE text not null,
+    PAYLOAD jsonb not null,
+    STATUS text not null default 'PENDING' check (STATUS in ('PENDING', 'DELIVERED', 'FAILED')),
+    ATTEMPTS integer not null default 0,
+    NEXT_ATTEMPT_AT timestamptz not null default current_timestamp,
+    CREATED_AT timestamptz not null default current_timestamp
+);
+
+create index WEBHOOK_OUTBOX_PENDING_IDX on WEBHOOK_OUTBOX (NEXT_ATTEMPT_AT) where STATUS = 'PENDING';
+
+create table WEBHOOK_DELIVERIES
+(
+    ID bigserial primary key,
+    OUTBOX_ID bigint not null references WEBHOOK_OUTBOX (ID) on delete cascade,
+    ATTEMPT integer not null,
+    STATUS_CODE integer not null default 0,
+    ERROR text not null default '',
+    ATTEMPTED_AT timestamptz not null default current_timestamp
+);
+
+create index WEBHOOK_DELIVERIES_OUTBOX_ID_IDX on WEBHOOK_DELIVERIES (OUTBOX_ID);
@@ -0,0 +1,10 @@
+create table OUTBOX
+(
+    ID bigserial primary key,
+    EVENT_TYPE text not null,
+    PAYLOAD jsonb not null,
+    CREATED_AT timestamptz not null default current_timestamp,
+    PUBLISHED_AT timestamptz
+);
+
+create index OUTBOX_UNPUBLISHED_IDX on OUTBOX (ID) where PUBLISHED_AT is null;
@@ -0,0 +1,29 @@
+create table ACCRUAL_ORDERS
+(
+    ORDER_NUMBER text primary key,
+    TOTAL numeric not null default 0 check (TOTAL >= 0),
+    CREATED_AT timestamptz not null default current_timestamp
+);
+
+create table ACCRUAL_ORDER_GOODS
+(
+    ID bigserial primary key,
+    ORDER_NUMBER text not null references ACCRUAL_ORDERS (ORDER_NUMBER) on delete cascade,
+    SKU text not null default '',
+    BRAND text not null default '',
+    DESCRIPTION text not null default '',
+    PRICE numeric not null check (PRICE >= 0),
+    QUANTITY integer not null default 1 check (QUANTITY > 0)
+);
+
+create index ACCRUAL_ORDER_GOODS_ORDER_NUMBER_IDX on ACCRUAL_ORDER_GOODS (ORDER_NUMBER);
+
+create table ACCRUAL_RULES
+(
+    ID bigserial primary key,
+    FIELD text not null check (FIELD in ('sku', 'brand', 'description', 'order')),
+    MATCH text not null default '',
+    REWARD numeric not null check (REWARD >= 0),
+    REWARD_TYPE text not null check (REWARD_TYPE in ('%', 'pt')),
+    CREATED_AT timestamptz not null default current_timestamp
+);
@@ -0,0 +1,13 @@
+create table IDEMPOTENCY_KEYS
+(
+    USER_ID bigint not null references USERS (ID),
+    KEY text not null,
+    REQUEST_HASH bytea not null,
+    STATUS_CODE integer,
+    CONTENT_TYPE text not null default '',
+    BODY bytea,
+    CREATED_AT timestamptz not null default current_timestamp,
+    primary key (USER_ID, KEY)
+);
+
+create index IDEMPOTENCY_KEYS_CREATED_AT_IDX on IDEMPOTENCY_KEYS (CREATED_AT);
@@ -0,0 +1,13 @@
+alter table WITHDRAWALS add column REVERSED numeric not null default 0;
+alter table WITHDRAWALS add constraint WITHDRAWALS_REVERSED_CHECK check (REVERSED >= 0 and REVERSED <= SUM);
+
+create table WITHDRAWAL_REVERSALS
+(
+    ID bigserial primary key,
+    ORDER_NUMBER text not null references WITHDRAWALS (ORDER_NUMBER),
+    SUM numeric not null check (SUM > 0),
+    REASON text not null default '',
+    CREATED_AT timestamptz not null default current_timestamp
+);
+
+create index WITHDRAWAL_REVERSALS_ORDER_NUMBER_IDX on WITHDRAWAL_REVERSALS (ORDER_NUMBER);
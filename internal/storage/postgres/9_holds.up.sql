@@ -0,0 +1,17 @@
+create table HOLDS
+(
+    ID bigserial primary key,
+    USER_ID bigint not null references USERS (ID),
+    ORDER_NUMBER text unique not null,
+    SUM numeric not null check (SUM > 0),
+    CAPTURED numeric not null default 0 check (CAPTURED >= 0 and CAPTURED <= SUM),
+    STATUS text not null default 'ACTIVE' check (STATUS in ('ACTIVE', 'CAPTURED', 'RELEASED', 'EXPIRED')),
+    EXPIRES_AT timestamptz not null,
+    CREATED_AT timestamptz not null default current_timestamp,
+    SETTLED_AT timestamptz
+);
+
+-- GetBalance, Withdraw, AddHold
+create index HOLDS_USER_ID_ACTIVE_IDX on HOLDS (USER_ID) where STATUS = 'ACTIVE';
+-- ExpireHolds
+create index HOLDS_EXPIRES_AT_ACTIVE_IDX on HOLDS (EXPIRES_AT) where STATUS = 'ACTIVE';
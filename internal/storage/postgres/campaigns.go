@@ -0,0 +1,107 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+const campaignColumns = `c.id, c.name, c.starts_at, c.ends_at, c.new_user_days, c.tiers, c.min_orders, c.max_orders,
+					c.effect, c.value, c.created_at`
+
+func (db *DB) AddCampaign(ctx context.Context, c storage.Campaign) (uint64, error) {
+	var id uint64
+
+	tiers := c.Tiers
+	if tiers == nil {
+		tiers = []string{}
+	}
+
+	query := `INSERT INTO campaigns (name, starts_at, ends_at, new_user_days, tiers, min_orders, max_orders, effect, value)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+	err := db.conn.QueryRow(ctx, query, c.Name, c.StartsAt, c.EndsAt, c.NewUserDays, tiers,
+		c.MinOrders, c.MaxOrders, c.Effect, c.Value).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (db *DB) GetCampaigns(ctx context.Context) ([]storage.Campaign, error) {
+	query := `SELECT ` + campaignColumns + `,
+					(SELECT COALESCE(SUM(l.amount), 0) FROM point_ledger l WHERE l.campaign_id = c.id)
+				FROM campaigns c ORDER BY c.id`
+
+	return db.queryCampaigns(ctx, query, true)
+}
+
+func (db *DB) GetActiveCampaigns(ctx context.Context, at time.Time) ([]storage.Campaign, error) {
+	query := `SELECT ` + campaignColumns + ` FROM campaigns c
+				WHERE c.starts_at <= $1 AND c.ends_at > $1 ORDER BY c.id`
+
+	return db.queryCampaigns(ctx, query, false, at)
+}
+
+func (db *DB) EndCampaign(ctx context.Context, id uint64) (bool, error) {
+	query := `UPDATE campaigns SET ends_at = GREATEST(now(), starts_at + interval '1 microsecond')
+				WHERE id = $1 AND ends_at > now()`
+	tag, err := db.conn.Exec(ctx, query, id)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (db *DB) GetUserStats(ctx context.Context, userID uint64) (storage.UserStats, error) {
+	var stats storage.UserStats
+
+	// concurrent first orders of the user must not both count as the first,
+	// the stats are read after the accrual that locked the account first commits
+	_, err := db.conn.Exec(ctx, `SELECT 1 FROM accounts WHERE user_id = $1 FOR UPDATE`, userID)
+	if err != nil {
+		return stats, err
+	}
+
+	query := `SELECT u.created_at,
+					(SELECT COUNT(*) FROM orders o WHERE o.user_id = u.id AND o.status = 'PROCESSED')
+				FROM users u WHERE u.id = $1`
+	err = db.conn.QueryRow(ctx, query, userID).Scan(&stats.RegisteredAt, &stats.ProcessedOrders)
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+func (db *DB) queryCampaigns(ctx context.Context, query string, awarded bool, args ...interface{}) ([]storage.Campaign, error) {
+	var result []storage.Campaign
+
+	rows, err := db.conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var c storage.Campaign
+		dest := []interface{}{&c.ID, &c.Name, &c.StartsAt, &c.EndsAt, &c.NewUserDays, &c.Tiers,
+			&c.MinOrders, &c.MaxOrders, &c.Effect, &c.Value, &c.CreatedAt}
+		if awarded {
+			dest = append(dest, &c.Awarded)
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,85 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+	"github.com/moorzeen/loyalty-service/internal/webhook"
+)
+
+// historyClause builds the filter, keyset and limit part of a history query.
+// args must already hold the leading query arguments, new ones are appended.
+func historyClause(hq storage.HistoryQuery, timeColumn string, args []interface{}) (string, []interface{}) {
+	var sb strings.Builder
+
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if len(hq.Statuses) > 0 {
+		fmt.Fprintf(&sb, " AND status = ANY(%s)", arg(hq.Statuses))
+	}
+	if !hq.From.IsZero() {
+		fmt.Fprintf(&sb, " AND %s >= %s", timeColumn, arg(hq.From))
+	}
+	if !hq.To.IsZero() {
+		fmt.Fprintf(&sb, " AND %s < %s", timeColumn, arg(hq.To))
+	}
+
+	cmp, dir := ">", "ASC"
+	if hq.Desc {
+		cmp, dir = "<", "DESC"
+	}
+
+	if hq.After != nil {
+		fmt.Fprintf(&sb, " AND (%s, order_number) %s (%s, %s)",
+			timeColumn, cmp, arg(hq.After.Time), arg(hq.After.OrderNumber))
+	}
+
+	fmt.Fprintf(&sb, " ORDER BY %s %s, order_number %s", timeColumn, dir, dir)
+
+	if hq.Limit > 0 {
+		fmt.Fprintf(&sb, " LIMIT %s", arg(hq.Limit))
+	}
+
+	return sb.String(), args
+}
+
+// addOutbox writes an event to the outbox using the caller's transaction,
+// so the event is published only if the change it describes is committed.
+// Deliveries to the subscribed user webhooks are enqueued with it.
+func addOutbox(ctx context.Context, q querier, eventType string, payload map[string]interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var id uint64
+	query := `INSERT INTO outbox (event_type, payload) VALUES ($1, $2) RETURNING id`
+	err = q.QueryRow(ctx, query, eventType, string(data)).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	targets, err := webhook.Targets(eventType, payload, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, t := range targets {
+		query = `INSERT INTO webhook_outbox (webhook_id, outbox_id, event_type, payload)
+					SELECT id, $3, $2, $4 FROM webhooks WHERE user_id = $1 AND $2 = ANY(event_types)`
+		_, err = q.Exec(ctx, query, t.UserID, t.EventType, id, string(t.Payload))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
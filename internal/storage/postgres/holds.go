@@ -0,0 +1,217 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/order"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// heldSum selects the points reserved by the active holds of the accounts row.
+// Holds past their expiry count as released even before ExpireHolds marks them.
+const heldSum = `(SELECT COALESCE(SUM(h.sum), 0) FROM holds h
+					WHERE h.user_id = accounts.user_id AND h.status = 'ACTIVE' AND h.expires_at > now())`
+
+const holdColumns = `id, user_id, order_number, sum, captured, status, expires_at, created_at, settled_at`
+
+func scanHold(row pgx.Row) (storage.Hold, error) {
+	var h storage.Hold
+	err := row.Scan(&h.ID, &h.UserID, &h.OrderNumber, &h.Sum, &h.Captured, &h.Status,
+		&h.ExpiresAt, &h.CreatedAt, &h.SettledAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return h, order.ErrHoldNotFound
+	}
+	return h, err
+}
+
+func (db *DB) AddHold(ctx context.Context, hold storage.Hold) (_ storage.Hold, err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return hold, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	// the account lock serializes holds and withdrawals of the user
+	var balance, held float64
+	balanceQuery := `SELECT balance, ` + heldSum + ` FROM accounts WHERE user_id = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, balanceQuery, hold.UserID).Scan(&balance, &held)
+	if err != nil {
+		return hold, err
+	}
+	if hold.Sum > balance-held {
+		err = order.ErrInsufficientFunds
+		return hold, err
+	}
+
+	query := `INSERT INTO holds (user_id, order_number, sum, expires_at) VALUES ($1, $2, $3, $4)
+				RETURNING ` + holdColumns
+	hold, err = scanHold(tx.QueryRow(ctx, query, hold.UserID, hold.OrderNumber, hold.Sum, hold.ExpiresAt))
+	if err != nil {
+		return hold, err
+	}
+
+	return hold, nil
+}
+
+func (db *DB) GetHold(ctx context.Context, userID uint64, id uint64) (storage.Hold, error) {
+	query := `SELECT ` + holdColumns + ` FROM holds WHERE id = $1 AND user_id = $2`
+	return scanHold(db.conn.QueryRow(ctx, query, id, userID))
+}
+
+// lockActiveHold locks the hold for settlement and checks that it is still active.
+func lockActiveHold(ctx context.Context, q querier, userID uint64, id uint64) (storage.Hold, error) {
+	query := `SELECT ` + holdColumns + ` FROM holds WHERE id = $1 AND user_id = $2 FOR UPDATE`
+	hold, err := scanHold(q.QueryRow(ctx, query, id, userID))
+	if err != nil {
+		return hold, err
+	}
+
+	switch {
+	case hold.Status != order.HoldActive:
+		return hold, order.ErrHoldNotActive
+	case !hold.ExpiresAt.After(time.Now()):
+		return hold, order.ErrHoldExpired
+	}
+
+	return hold, nil
+}
+
+func (db *DB) CaptureHold(ctx context.Context, userID uint64, id uint64, sum float64) (hold storage.Hold, err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return storage.Hold{}, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	// lock the account first, the same order as Withdraw and AddHold
+	var balance float64
+	err = tx.QueryRow(ctx, `SELECT balance FROM accounts WHERE user_id = $1 FOR UPDATE`, userID).Scan(&balance)
+	if err != nil {
+		return storage.Hold{}, err
+	}
+
+	hold, err = lockActiveHold(ctx, tx, userID, id)
+	if err != nil {
+		return hold, err
+	}
+
+	switch {
+	case sum == 0:
+		sum = hold.Sum
+	case sum > hold.Sum:
+		err = order.ErrCaptureTooLarge
+		return hold, err
+	}
+	// held points could have expired meanwhile
+	if sum > balance {
+		err = order.ErrInsufficientFunds
+		return hold, err
+	}
+
+	addWithdrawQuery := `INSERT INTO withdrawals (user_id, order_number, sum) VALUES ($1, $2, $3)`
+	_, err = tx.Exec(ctx, addWithdrawQuery, userID, hold.OrderNumber, sum)
+	if err != nil {
+		return hold, err
+	}
+
+	updateBalanceQuery := `UPDATE accounts SET balance = balance - $1, withdrawn = withdrawn + $1 WHERE user_id = $2`
+	_, err = tx.Exec(ctx, updateBalanceQuery, sum, userID)
+	if err != nil {
+		return hold, err
+	}
+
+	err = consumeLots(ctx, tx, userID, sum, storage.LedgerWithdrawal, hold.OrderNumber)
+	if err != nil {
+		return hold, err
+	}
+
+	query := `UPDATE holds SET status = 'CAPTURED', captured = $2, settled_at = now() WHERE id = $1
+				RETURNING ` + holdColumns
+	hold, err = scanHold(tx.QueryRow(ctx, query, id, sum))
+	if err != nil {
+		return hold, err
+	}
+
+	err = addOutbox(ctx, tx, events.BalanceWithdrawn, map[string]interface{}{
+		"user_id": userID,
+		"order":   hold.OrderNumber,
+		"amount":  sum,
+		"hold_id": hold.ID,
+	})
+	if err != nil {
+		return hold, err
+	}
+
+	return hold, nil
+}
+
+func (db *DB) ReleaseHold(ctx context.Context, userID uint64, id uint64) (hold storage.Hold, err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return storage.Hold{}, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	hold, err = lockActiveHold(ctx, tx, userID, id)
+	if err != nil {
+		return hold, err
+	}
+
+	query := `UPDATE holds SET status = 'RELEASED', settled_at = now() WHERE id = $1 RETURNING ` + holdColumns
+	hold, err = scanHold(tx.QueryRow(ctx, query, id))
+	if err != nil {
+		return hold, err
+	}
+
+	return hold, nil
+}
+
+func (db *DB) ExpireHolds(ctx context.Context) ([]storage.Hold, error) {
+	var result []storage.Hold
+
+	query := `UPDATE holds SET status = 'EXPIRED', settled_at = expires_at
+				WHERE status = 'ACTIVE' AND expires_at <= now()
+				RETURNING ` + holdColumns
+	rows, err := db.conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		h, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, h)
+	}
+
+	return result, nil
+}
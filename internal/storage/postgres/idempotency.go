@@ -0,0 +1,76 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+func (db *DB) ClaimIdempotencyKey(ctx context.Context, key storage.IdempotencyKey, expiredBefore, leasedBefore time.Time) (storage.IdempotencyKey, bool, error) {
+	// an expired key and a claim abandoned by a crashed request are taken over as if they were new
+	query := `INSERT INTO idempotency_keys (user_id, key, request_hash) VALUES ($1, $2, $3)
+				ON CONFLICT (user_id, key) DO UPDATE
+					SET request_hash = EXCLUDED.request_hash, status_code = NULL,
+						content_type = '', body = NULL, created_at = now()
+					WHERE idempotency_keys.created_at < $4
+						OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < $5)
+				RETURNING created_at`
+	err := db.conn.QueryRow(ctx, query, key.UserID, key.Key, key.RequestHash, expiredBefore, leasedBefore).Scan(&key.CreatedAt)
+	if err == nil {
+		return key, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return key, false, err
+	}
+
+	var (
+		stored     storage.IdempotencyKey
+		statusCode *int
+	)
+	query = `SELECT user_id, key, request_hash, status_code, content_type, body, created_at
+				FROM idempotency_keys WHERE user_id = $1 AND key = $2`
+	err = db.conn.QueryRow(ctx, query, key.UserID, key.Key).Scan(&stored.UserID, &stored.Key,
+		&stored.RequestHash, &statusCode, &stored.ContentType, &stored.Body, &stored.CreatedAt)
+	if err != nil {
+		return stored, false, err
+	}
+	if statusCode != nil {
+		stored.StatusCode = *statusCode
+	}
+
+	return stored, false, nil
+}
+
+func (db *DB) SaveIdempotencyResponse(ctx context.Context, key storage.IdempotencyKey) error {
+	query := `UPDATE idempotency_keys SET status_code = $3, content_type = $4, body = $5
+				WHERE user_id = $1 AND key = $2`
+	_, err := db.conn.Exec(ctx, query, key.UserID, key.Key, key.StatusCode, key.ContentType, key.Body)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *DB) DeleteIdempotencyKey(ctx context.Context, userID uint64, key string) error {
+	query := `DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2`
+	_, err := db.conn.Exec(ctx, query, userID, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *DB) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM idempotency_keys WHERE created_at < $1`
+	tag, err := db.conn.Exec(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
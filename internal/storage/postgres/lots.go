@@ -0,0 +1,299 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// The balance of an account always equals the remaining points of its lots.
+// Credits add a lot, debits consume the lots expiring first and the oldest of
+// those expiring together, and every lot change is written to the point ledger. Callers lock the accounts row beforehand.
+
+// addLot adds a lot of the credit and its ledger entry.
+func addLot(ctx context.Context, q querier, credit storage.Credit) error {
+	if credit.Amount <= 0 {
+		return nil
+	}
+
+	var expiresAt *time.Time
+	if !credit.ExpiresAt.IsZero() {
+		expiresAt = &credit.ExpiresAt
+	}
+
+	query := `WITH lot AS (
+					INSERT INTO point_lots (user_id, kind, order_number, amount, remaining, expires_at)
+					VALUES ($1, $2, $3, $4, $4, $5) RETURNING id
+				)
+				INSERT INTO point_ledger (user_id, lot_id, kind, amount, order_number, campaign_id, transfer_id)
+				SELECT $1, id, $2, $4, $3, NULLIF($6::bigint, 0), NULLIF($7::bigint, 0) FROM lot`
+	_, err := q.Exec(ctx, query, credit.UserID, credit.Kind, credit.OrderNumber, credit.Amount, expiresAt,
+		int64(credit.CampaignID), int64(credit.TransferID))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// lotPrecision absorbs the float rounding of numeric lot amounts
+const lotPrecision = 1e-9
+
+// lot is an open lot of points, or the part of it taken by splitLots.
+type lot struct {
+	id        uint64
+	remaining float64
+	expiresAt time.Time // zero if the points never expire
+}
+
+// splitLots takes amount from the lots in their order. It fails when the
+// lots hold less, the balance and the lots then disagree.
+func splitLots(lots []lot, amount float64) ([]lot, error) {
+	var parts []lot
+	for _, l := range lots {
+		if amount <= lotPrecision {
+			break
+		}
+
+		spent := l.remaining
+		if spent-amount > lotPrecision {
+			spent = amount
+		}
+		amount -= spent
+		parts = append(parts, lot{id: l.id, remaining: spent, expiresAt: l.expiresAt})
+	}
+
+	if amount > lotPrecision {
+		return nil, fmt.Errorf("lots are short of %v points", amount)
+	}
+
+	return parts, nil
+}
+
+// expirable is the amount of the expired lots that can be written off
+// while the balance still covers the points on hold.
+func expirable(expired []lot, balance, held float64) float64 {
+	var amount float64
+	for _, l := range expired {
+		amount += l.remaining
+	}
+	if amount > balance-held {
+		amount = balance - held
+	}
+	if amount < 0 {
+		return 0
+	}
+	return amount
+}
+
+// scanLots reads the id, remaining and expires_at columns of lots.
+func scanLots(rows pgx.Rows) ([]lot, error) {
+	defer rows.Close()
+
+	var lots []lot
+	for rows.Next() {
+		var (
+			l         lot
+			expiresAt *time.Time
+		)
+		err := rows.Scan(&l.id, &l.remaining, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		if expiresAt != nil {
+			l.expiresAt = *expiresAt
+		}
+		lots = append(lots, l)
+	}
+
+	return lots, rows.Err()
+}
+
+// debitLots writes off the parts of lots and their ledger entries, which refer
+// to the order or the transfer.
+func debitLots(ctx context.Context, q querier, parts []lot, kind string, orderNumber string, transferID uint64) error {
+	query := `WITH lot AS (
+					UPDATE point_lots SET remaining = remaining - $2 WHERE id = $1 RETURNING id, user_id
+				)
+				INSERT INTO point_ledger (user_id, lot_id, kind, amount, order_number, transfer_id)
+				SELECT user_id, id, $3, -$2::numeric, $4, NULLIF($5::bigint, 0) FROM lot`
+	for _, p := range parts {
+		_, err := q.Exec(ctx, query, p.id, p.remaining, kind, orderNumber, int64(transferID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// takeLots locks the open lots of the user and splits amount off the ones
+// expiring first. Received transfers keep their expiry, so a newer lot may
+// expire before an older one.
+func takeLots(ctx context.Context, q querier, userID uint64, amount float64) ([]lot, error) {
+	query := `SELECT id, remaining, expires_at FROM point_lots
+				WHERE user_id = $1 AND remaining > 0
+				ORDER BY expires_at NULLS LAST, id FOR UPDATE`
+	rows, err := q.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	lots, err := scanLots(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := splitLots(lots, amount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to debit user %d: %w", userID, err)
+	}
+
+	return parts, nil
+}
+
+// consumeLots debits amount from the lots of the user expiring first.
+func consumeLots(ctx context.Context, q querier, userID uint64, amount float64, kind string, orderNumber string) error {
+	parts, err := takeLots(ctx, q, userID, amount)
+	if err != nil {
+		return err
+	}
+
+	return debitLots(ctx, q, parts, kind, orderNumber, 0)
+}
+
+func (db *DB) GetExpirations(ctx context.Context, userID uint64, limit int) ([]storage.Expiration, error) {
+	var result []storage.Expiration
+
+	query := `SELECT SUM(remaining), expires_at FROM point_lots
+				WHERE user_id = $1 AND remaining > 0 AND expires_at IS NOT NULL
+				GROUP BY expires_at ORDER BY expires_at LIMIT $2`
+	rows, err := db.conn.Query(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var e storage.Expiration
+		err = rows.Scan(&e.Amount, &e.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+
+	return result, nil
+}
+
+func (db *DB) ExpirePoints(ctx context.Context, before time.Time, users int) ([]storage.ExpiredPoints, error) {
+	var userIDs []uint64
+
+	// points on hold don't expire, users with all the balance held are skipped
+	query := `SELECT DISTINCT p.user_id FROM point_lots p
+				JOIN accounts ON accounts.user_id = p.user_id
+				WHERE p.remaining > 0 AND p.expires_at <= $1 AND accounts.balance > ` + heldSum + `
+				LIMIT $2`
+	rows, err := db.conn.Query(ctx, query, before, users)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id uint64
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]storage.ExpiredPoints, 0, len(userIDs))
+	for _, userID := range userIDs {
+		amount, err := db.expireUserPoints(ctx, userID, before)
+		if err != nil {
+			return result, err
+		}
+		if amount > 0 {
+			result = append(result, storage.ExpiredPoints{UserID: userID, Amount: amount})
+		}
+	}
+
+	return result, nil
+}
+
+// expireUserPoints writes off the user lots expired before, one transaction per user.
+// Points on hold are kept, so the balance still covers the holds.
+func (db *DB) expireUserPoints(ctx context.Context, userID uint64, before time.Time) (amount float64, err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	// the account is locked first, the same order as withdrawals take
+	var balance, held float64
+	balanceQuery := `SELECT balance, ` + heldSum + ` FROM accounts WHERE user_id = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, balanceQuery, userID).Scan(&balance, &held)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `SELECT id, remaining, expires_at FROM point_lots
+				WHERE user_id = $1 AND remaining > 0 AND expires_at <= $2
+				ORDER BY expires_at, id FOR UPDATE`
+	rows, err := tx.Query(ctx, query, userID, before)
+	if err != nil {
+		return 0, err
+	}
+	expired, err := scanLots(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	amount = expirable(expired, balance, held)
+	if amount <= 0 {
+		return 0, nil
+	}
+
+	parts, err := splitLots(expired, amount)
+	if err != nil {
+		return 0, err
+	}
+	err = debitLots(ctx, tx, parts, storage.LedgerExpiry, "", 0)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE accounts SET balance = balance - $1 WHERE user_id = $2`, amount, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = addOutbox(ctx, tx, events.PointsExpired, map[string]interface{}{
+		"user_id": userID,
+		"amount":  amount,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return amount, nil
+}
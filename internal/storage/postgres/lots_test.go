@@ -0,0 +1,80 @@
+package postgres
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitLots(t *testing.T) {
+	// lots come in the takeLots order: expiring first, the migrated balance
+	// that never expires last; parts keep the expiry of their lots
+	first := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.AddDate(0, 1, 0)
+	migration := lot{id: 1, remaining: 30}
+	lots := []lot{{id: 2, remaining: 50, expiresAt: first}, {id: 3, remaining: 20, expiresAt: second}, migration}
+
+	// a transfer received later keeps an expiry earlier than the own lot
+	received := []lot{{id: 5, remaining: 40, expiresAt: first}, {id: 4, remaining: 60, expiresAt: second}}
+
+	tests := []struct {
+		name   string
+		lots   []lot
+		amount float64
+		want   []lot
+	}{
+		{"first expiring only", lots, 10, []lot{{id: 2, remaining: 10, expiresAt: first}}},
+		{"whole first expiring lot", lots, 50, []lot{{id: 2, remaining: 50, expiresAt: first}}},
+		{"expiring first", lots, 60, []lot{{id: 2, remaining: 50, expiresAt: first}, {id: 3, remaining: 10, expiresAt: second}}},
+		{"migration lot last", lots, 80, []lot{{id: 2, remaining: 50, expiresAt: first}, {id: 3, remaining: 20, expiresAt: second}, {id: 1, remaining: 10}}},
+		{"all lots", lots, 100, []lot{{id: 2, remaining: 50, expiresAt: first}, {id: 3, remaining: 20, expiresAt: second}, {id: 1, remaining: 30}}},
+		{"received lot first", received, 50, []lot{{id: 5, remaining: 40, expiresAt: first}, {id: 4, remaining: 10, expiresAt: second}}},
+		{"float rounding", []lot{{id: 1, remaining: 0.1}, {id: 2, remaining: 0.2}}, 0.3, []lot{{id: 1, remaining: 0.1}, {id: 2, remaining: 0.2}}},
+		{"nothing", lots, 0, nil},
+	}
+
+	for _, tt := range tests {
+		got, err := splitLots(tt.lots, tt.amount)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitLotsShortfall(t *testing.T) {
+	lots := []lot{{id: 1, remaining: 30}, {id: 2, remaining: 50}}
+
+	if _, err := splitLots(lots, 80.5); err == nil {
+		t.Error("split more than the lots hold")
+	}
+	if _, err := splitLots(nil, 1); err == nil {
+		t.Error("split without lots")
+	}
+}
+
+func TestExpirable(t *testing.T) {
+	expired := []lot{{id: 1, remaining: 30}, {id: 2, remaining: 20}}
+
+	tests := []struct {
+		name    string
+		balance float64
+		held    float64
+		want    float64
+	}{
+		{"no holds", 100, 0, 50},
+		{"holds covered by fresh points", 100, 50, 50},
+		{"holds on expired points", 100, 70, 30},
+		{"all held", 100, 100, 0},
+		{"only expired points", 50, 0, 50},
+	}
+
+	for _, tt := range tests {
+		if got := expirable(expired, tt.balance, tt.held); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,15 +1,28 @@
 package postgres
 
 import (
+	"embed"
 	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 )
 
+// migrations are built into the binary, so it runs from any directory
+//
+//go:embed *.sql
+var migrations embed.FS
+
 func Migration(databaseURL string) error {
-	m, err := migrate.New("file://internal/storage/postgres/", databaseURL)
+	src, err := iofs.New(migrations, ".")
+	if err != nil {
+		return fmt.Errorf("failed to read DB migrations: %w", err)
+	}
+	m, err := migrate.NewWithSourceInstance("iofs", src, databaseURL)
 	if err != nil {
 		return fmt.Errorf("failed to init DB migrations: %w", err)
 	}
@@ -19,3 +32,29 @@ func Migration(databaseURL string) error {
 	}
 	return nil
 }
+
+// LatestMigration returns the version of the newest migration file,
+// the schema version expected after Migration.
+func LatestMigration() (uint, error) {
+	entries, err := fs.ReadDir(migrations, ".")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	var latest uint64
+	for _, e := range entries {
+		prefix, _, ok := strings.Cut(e.Name(), "_")
+		if !ok || !strings.HasSuffix(e.Name(), ".up.sql") {
+			continue
+		}
+		v, err := strconv.ParseUint(prefix, 10, 64)
+		if err != nil {
+			continue
+		}
+		if v > latest {
+			latest = v
+		}
+	}
+
+	return uint(latest), nil
+}
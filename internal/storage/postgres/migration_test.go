@@ -0,0 +1,22 @@
+package postgres
+
+import (
+	"io/fs"
+	"testing"
+)
+
+func TestLatestMigration(t *testing.T) {
+	latest, err := LatestMigration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// versions are numbered without gaps
+	ups, err := fs.Glob(migrations, "*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == 0 || latest != uint(len(ups)) {
+		t.Errorf("got latest migration %d of %d embedded", latest, len(ups))
+	}
+}
@@ -0,0 +1,101 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/moorzeen/loyalty-service/internal/events"
+)
+
+const eventsChannel = "loyalty_events"
+
+// Bridge relays events between service replicas through Postgres LISTEN/NOTIFY.
+// Published events are delivered to the local hub by the listener as well,
+// so every replica, including the publishing one, gets each event once.
+type Bridge struct {
+	pool *pgxpool.Pool
+	hub  *events.Hub
+}
+
+// notification is the wire form of events.Event, which hides the user ID from clients.
+type notification struct {
+	events.Event
+	UserID uint64 `json:"user_id"`
+}
+
+func NewBridge(ctx context.Context, link string, hub *events.Hub) (*Bridge, error) {
+	cfg, err := pgxpool.ParseConfig(link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database URI: %w", err)
+	}
+	cfg.MaxConns = 2
+
+	pool, err := pgxpool.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a notification connection pool: %w", err)
+	}
+
+	b := &Bridge{pool: pool, hub: hub}
+	go b.listen(ctx)
+
+	return b, nil
+}
+
+func (b *Bridge) Publish(ctx context.Context, e events.Event) error {
+	payload, err := json.Marshal(notification{Event: e, UserID: e.UserID})
+	if err != nil {
+		return err
+	}
+
+	_, err = b.pool.Exec(ctx, `SELECT pg_notify($1, $2)`, eventsChannel, string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to notify %s: %w", eventsChannel, err)
+	}
+
+	return nil
+}
+
+// listen forwards notifications to the hub and reconnects on errors until ctx is done.
+func (b *Bridge) listen(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := b.wait(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Events listener error", "error", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (b *Bridge) wait(ctx context.Context) error {
+	conn, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "LISTEN "+eventsChannel)
+	if err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var msg notification
+		err = json.Unmarshal([]byte(n.Payload), &msg)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to parse event notification", "error", err)
+			continue
+		}
+
+		msg.Event.UserID = msg.UserID
+		b.hub.Publish(ctx, msg.Event)
+	}
+}
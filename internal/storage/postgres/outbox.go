@@ -0,0 +1,65 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// GetOutbox returns the oldest unpublished messages and locks them until the
+// end of the transaction. SKIP LOCKED lets relays of several replicas run
+// concurrently, so it has to be called within WithTx.
+func (db *DB) GetOutbox(ctx context.Context, limit int) ([]storage.OutboxMessage, error) {
+	var result []storage.OutboxMessage
+
+	query := `SELECT id, event_type, payload::text, created_at FROM outbox
+				WHERE published_at IS NULL
+				ORDER BY id LIMIT $1
+				FOR UPDATE SKIP LOCKED`
+	rows, err := db.conn.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var (
+			m       storage.OutboxMessage
+			payload string
+		)
+		err = rows.Scan(&m.ID, &m.Type, &payload, &m.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		m.Payload = []byte(payload)
+		result = append(result, m)
+	}
+
+	return result, nil
+}
+
+func (db *DB) MarkOutboxPublished(ctx context.Context, ids []uint64) error {
+	query := `UPDATE outbox SET published_at = now() WHERE id = ANY($1)`
+	_, err := db.conn.Exec(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *DB) PurgeOutbox(ctx context.Context, before time.Time, unpublished bool) (int64, error) {
+	query := `DELETE FROM outbox
+				WHERE published_at < $1 OR ($2 AND published_at IS NULL AND created_at < $1)`
+	tag, err := db.conn.Exec(ctx, query, before, unpublished)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -2,16 +2,31 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/metrics"
 	"github.com/moorzeen/loyalty-service/internal/order"
 	"github.com/moorzeen/loyalty-service/internal/storage"
 )
 
+// querier is satisfied both by the connection pool and by a transaction,
+// so the same DB methods work inside and outside WithTx.
+type querier interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
 type DB struct {
 	pool *pgxpool.Pool
+	conn querier
 }
 
 func NewStorage(ctx context.Context, link string) (storage.Service, error) {
@@ -20,14 +35,57 @@ func NewStorage(ctx context.Context, link string) (storage.Service, error) {
 		return nil, fmt.Errorf("failed to create a new connection pool: %w", err)
 	}
 
-	return &DB{pool: pool}, nil
+	metrics.Registry.MustRegister(newPoolCollector(pool))
+
+	return &DB{pool: pool, conn: tracedQuerier{querier: pool}}, nil
+}
+
+func (db *DB) WithTx(ctx context.Context, fn func(tx storage.Tx) error) (err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	err = fn(&DB{pool: db.pool, conn: tx})
+	return err
+}
+
+func (db *DB) Ping(ctx context.Context) error {
+	return db.pool.Ping(ctx)
+}
+
+func (db *DB) SchemaVersion(ctx context.Context) (uint, bool, error) {
+	var (
+		version uint
+		dirty   bool
+	)
+
+	err := db.conn.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return version, dirty, nil
 }
 
 func (db *DB) AddUser(ctx context.Context, username string, passwordHash []byte) (uint64, error) {
 	var userID uint64
 
-	query := `INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id`
-	err := db.pool.QueryRow(ctx, query, username, passwordHash).Scan(&userID)
+	query := `WITH inserted AS (
+					INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id
+				), event AS (
+					INSERT INTO outbox (event_type, payload)
+					SELECT $3, json_build_object('user_id', id, 'login', $1::text) FROM inserted
+				)
+				SELECT id FROM inserted`
+	err := db.conn.QueryRow(ctx, query, username, passwordHash, events.UserRegistered).Scan(&userID)
 	if err != nil {
 		return 0, err
 	}
@@ -37,7 +95,7 @@ func (db *DB) AddUser(ctx context.Context, username string, passwordHash []byte)
 
 func (db *DB) AddAccount(ctx context.Context, userID uint64) error {
 	query := `INSERT INTO accounts (user_id) VALUES ($1)`
-	_, err := db.pool.Exec(ctx, query, userID)
+	_, err := db.conn.Exec(ctx, query, userID)
 	if err != nil {
 		return err
 	}
@@ -49,7 +107,7 @@ func (db *DB) GetUser(ctx context.Context, username string) (*storage.User, erro
 	user := &storage.User{}
 
 	query := `SELECT id, username, password_hash FROM users WHERE username = $1`
-	err := db.pool.QueryRow(ctx, query, username).Scan(&user.ID, &user.Username, &user.PasswordHash)
+	err := db.conn.QueryRow(ctx, query, username).Scan(&user.ID, &user.Username, &user.PasswordHash)
 	if err != nil {
 		return nil, err
 	}
@@ -59,7 +117,7 @@ func (db *DB) GetUser(ctx context.Context, username string) (*storage.User, erro
 
 func (db *DB) SetSession(ctx context.Context, userID uint64, signKey []byte) error {
 	query := `INSERT INTO sessions (user_id, sign_key) VALUES($1, $2) ON CONFLICT (user_id) DO UPDATE SET sign_key = $2`
-	_, err := db.pool.Exec(ctx, query, userID, signKey)
+	_, err := db.conn.Exec(ctx, query, userID, signKey)
 	if err != nil {
 		return err
 	}
@@ -70,7 +128,7 @@ func (db *DB) GetSession(ctx context.Context, userID uint64) (*storage.Session,
 	session := &storage.Session{}
 
 	query := `SELECT user_id, sign_key FROM sessions WHERE user_id = $1`
-	err := db.pool.QueryRow(ctx, query, userID).Scan(&session.UserID, &session.SignKey)
+	err := db.conn.QueryRow(ctx, query, userID).Scan(&session.UserID, &session.SignKey)
 	if err != nil {
 		return nil, err
 	}
@@ -79,19 +137,115 @@ func (db *DB) GetSession(ctx context.Context, userID uint64) (*storage.Session,
 }
 
 func (db *DB) AddOrder(ctx context.Context, number string, userID uint64) error {
-	query := `INSERT INTO orders (order_number, user_id, status) VALUES ($1, $2, $3)`
-	_, err := db.pool.Exec(ctx, query, number, userID, "NEW")
+	query := `WITH inserted AS (
+					INSERT INTO orders (order_number, user_id, status) VALUES ($1, $2, $3)
+					RETURNING order_number, user_id, status
+				)
+				INSERT INTO outbox (event_type, payload)
+				SELECT $4, json_build_object('order', order_number, 'user_id', user_id, 'status', status) FROM inserted`
+	_, err := db.conn.Exec(ctx, query, number, userID, order.StatusNew, events.OrderAdded)
 	if err != nil {
 		return err
 	}
+	metrics.OrdersAdded.Inc()
 	return nil
 }
 
+// AddOrders inserts distinct order numbers in one statement. The joined orders
+// table is read from the statement snapshot, which misses numbers inserted
+// concurrently by other users, so owners of the conflicting numbers are read
+// again afterwards.
+func (db *DB) AddOrders(ctx context.Context, numbers []string, userID uint64) ([]storage.AddedOrder, error) {
+	var (
+		result    []storage.AddedOrder
+		conflicts []string
+	)
+
+	query := `WITH input AS (SELECT unnest($1::text[]) AS order_number),
+				inserted AS (
+					INSERT INTO orders (order_number, user_id, status)
+					SELECT order_number, $2, $3 FROM input
+					ON CONFLICT (order_number) DO NOTHING
+					RETURNING order_number
+				), event AS (
+					INSERT INTO outbox (event_type, payload)
+					SELECT $4, json_build_object('order', order_number, 'user_id', $2::bigint, 'status', $3::text)
+					FROM inserted
+				)
+				SELECT i.order_number, inserted.order_number IS NOT NULL, COALESCE(o.user_id, $2)
+				FROM input i
+				LEFT JOIN inserted ON inserted.order_number = i.order_number
+				LEFT JOIN orders o ON o.order_number = i.order_number`
+	rows, err := db.conn.Query(ctx, query, numbers, userID, order.StatusNew, events.OrderAdded)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var o storage.AddedOrder
+		err = rows.Scan(&o.OrderNumber, &o.Added, &o.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if o.Added {
+			metrics.OrdersAdded.Inc()
+		} else {
+			conflicts = append(conflicts, o.OrderNumber)
+		}
+		result = append(result, o)
+	}
+
+	if len(conflicts) == 0 {
+		return result, nil
+	}
+
+	owners, err := db.getOrderOwners(ctx, conflicts)
+	if err != nil {
+		return nil, err
+	}
+	for i, o := range result {
+		if owner, ok := owners[o.OrderNumber]; ok && !o.Added {
+			result[i].UserID = owner
+		}
+	}
+
+	return result, nil
+}
+
+func (db *DB) getOrderOwners(ctx context.Context, numbers []string) (map[string]uint64, error) {
+	owners := make(map[string]uint64, len(numbers))
+
+	rows, err := db.conn.Query(ctx, `SELECT order_number, user_id FROM orders WHERE order_number = ANY($1)`, numbers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			number string
+			owner  uint64
+		)
+		err = rows.Scan(&number, &owner)
+		if err != nil {
+			return nil, err
+		}
+		owners[number] = owner
+	}
+
+	return owners, rows.Err()
+}
+
 func (db *DB) GetOrder(ctx context.Context, number string) (*storage.Order, error) {
 	order := &storage.Order{}
 
 	query := `SELECT order_number, user_id, status, uploaded_at, accrual FROM orders WHERE order_number = $1`
-	err := db.pool.QueryRow(ctx, query, number).Scan(
+	err := db.conn.QueryRow(ctx, query, number).Scan(
 		&order.OrderNumber,
 		&order.UserID,
 		&order.Status,
@@ -105,12 +259,13 @@ func (db *DB) GetOrder(ctx context.Context, number string) (*storage.Order, erro
 	return order, nil
 }
 
-func (db *DB) GetOrders(ctx context.Context, userID uint64) ([]storage.Order, error) {
+func (db *DB) GetOrders(ctx context.Context, userID uint64, hq storage.HistoryQuery) ([]storage.Order, error) {
 	var orders []storage.Order
 
+	clause, args := historyClause(hq, "uploaded_at", []interface{}{userID})
 	query := `SELECT user_id, order_number, status, uploaded_at, accrual
-				FROM orders WHERE user_id = $1 order by uploaded_at`
-	rows, err := db.pool.Query(ctx, query, userID)
+				FROM orders WHERE user_id = $1` + clause
+	rows, err := db.conn.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -132,20 +287,21 @@ func (db *DB) GetOrders(ctx context.Context, userID uint64) ([]storage.Order, er
 	return orders, nil
 }
 
-func (db *DB) GetBalance(ctx context.Context, userID uint64) (float64, float64, error) {
-	var bal, wtn float64
+func (db *DB) GetBalance(ctx context.Context, userID uint64) (storage.Balance, error) {
+	var bal storage.Balance
 
-	balQuery := `SELECT balance, withdrawn FROM accounts WHERE user_id = $1`
-	err := db.pool.QueryRow(ctx, balQuery, userID).Scan(&bal, &wtn)
+	balQuery := `SELECT balance, withdrawn, ` + heldSum + ` FROM accounts WHERE user_id = $1`
+	err := db.conn.QueryRow(ctx, balQuery, userID).Scan(&bal.Current, &bal.Withdrawn, &bal.Held)
 	if err != nil {
-		return 0, 0, err
+		return bal, err
 	}
+	bal.Current -= bal.Held
 
-	return bal, wtn, nil
+	return bal, nil
 }
 
-func (db *DB) Withdraw(ctx context.Context, userID uint64, number string, wth float64) error {
-	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{})
+func (db *DB) Withdraw(ctx context.Context, userID uint64, number string, wth float64) (err error) {
+	tx, err := db.conn.Begin(ctx)
 	if err != nil {
 		return err
 	}
@@ -153,18 +309,18 @@ func (db *DB) Withdraw(ctx context.Context, userID uint64, number string, wth fl
 		if err != nil {
 			tx.Rollback(ctx)
 		} else {
-			tx.Commit(ctx)
+			err = tx.Commit(ctx)
 		}
 	}()
 
-	// confirm that funds is enough for the withdrawal
-	var balance float64
-	balanceQuery := `SELECT balance FROM accounts WHERE user_id = $1 FOR UPDATE`
-	err = tx.QueryRow(ctx, balanceQuery, userID).Scan(&balance)
+	// confirm that funds is enough for the withdrawal, points on hold are reserved
+	var balance, held float64
+	balanceQuery := `SELECT balance, ` + heldSum + ` FROM accounts WHERE user_id = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, balanceQuery, userID).Scan(&balance, &held)
 	if err != nil {
 		return err
 	}
-	if wth > balance {
+	if wth > balance-held {
 		return order.ErrInsufficientFunds
 	}
 
@@ -182,14 +338,30 @@ func (db *DB) Withdraw(ctx context.Context, userID uint64, number string, wth fl
 		return err
 	}
 
+	err = consumeLots(ctx, tx, userID, wth, storage.LedgerWithdrawal, number)
+	if err != nil {
+		return err
+	}
+
+	err = addOutbox(ctx, tx, events.BalanceWithdrawn, map[string]interface{}{
+		"user_id": userID,
+		"order":   number,
+		"amount":  wth,
+	})
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func (db *DB) GetWithdrawals(ctx context.Context, userID uint64) ([]storage.Withdrawal, error) {
+func (db *DB) GetWithdrawals(ctx context.Context, userID uint64, hq storage.HistoryQuery) ([]storage.Withdrawal, error) {
 	var result []storage.Withdrawal
 
-	query := `SELECT order_number, sum, processed_at FROM withdrawals WHERE user_id = $1 order by processed_at`
-	rows, err := db.pool.Query(ctx, query, userID)
+	hq.Statuses = nil
+	clause, args := historyClause(hq, "processed_at", []interface{}{userID})
+	query := `SELECT order_number, sum, reversed, processed_at FROM withdrawals WHERE user_id = $1` + clause
+	rows, err := db.conn.Query(ctx, query, args...)
 	if err != nil {
 		return result, err
 	}
@@ -201,7 +373,7 @@ func (db *DB) GetWithdrawals(ctx context.Context, userID uint64) ([]storage.With
 
 	for rows.Next() {
 		var o storage.Withdrawal
-		err = rows.Scan(&o.OrderNumber, &o.Sum, &o.ProcessedAt)
+		err = rows.Scan(&o.OrderNumber, &o.Sum, &o.Reversed, &o.ProcessedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -212,11 +384,93 @@ func (db *DB) GetWithdrawals(ctx context.Context, userID uint64) ([]storage.With
 
 }
 
-func (db *DB) GetProcessingOrders() ([]string, error) {
+func (db *DB) ReverseWithdrawal(ctx context.Context, number string, sum float64, reason string, expiresAt time.Time) (rev storage.WithdrawalReversal, err error) {
+	rev = storage.WithdrawalReversal{OrderNumber: number, Reason: reason}
+
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return rev, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	// lock the withdrawal, concurrent reversals must not exceed its sum
+	var withdrawn, reversed float64
+	withdrawalQuery := `SELECT user_id, sum, reversed FROM withdrawals WHERE order_number = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, withdrawalQuery, number).Scan(&rev.UserID, &withdrawn, &reversed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = order.ErrWithdrawalNotFound
+		return rev, err
+	}
+	if err != nil {
+		return rev, err
+	}
+
+	remainder := withdrawn - reversed
+	switch {
+	case remainder <= 0:
+		err = order.ErrAlreadyReversed
+		return rev, err
+	case sum == 0:
+		sum = remainder
+	case sum > remainder:
+		err = order.ErrReversalTooLarge
+		return rev, err
+	}
+	rev.Sum = sum
+
+	_, err = tx.Exec(ctx, `UPDATE withdrawals SET reversed = reversed + $1 WHERE order_number = $2`, sum, number)
+	if err != nil {
+		return rev, err
+	}
+
+	updateBalanceQuery := `UPDATE accounts SET balance = balance + $1, withdrawn = withdrawn - $1 WHERE user_id = $2`
+	_, err = tx.Exec(ctx, updateBalanceQuery, sum, rev.UserID)
+	if err != nil {
+		return rev, err
+	}
+
+	err = addLot(ctx, tx, storage.Credit{
+		UserID:      rev.UserID,
+		Kind:        storage.LedgerReversal,
+		OrderNumber: number,
+		Amount:      sum,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		return rev, err
+	}
+
+	addReversalQuery := `INSERT INTO withdrawal_reversals (order_number, sum, reason) VALUES ($1, $2, $3)
+							RETURNING id, created_at`
+	err = tx.QueryRow(ctx, addReversalQuery, number, sum, reason).Scan(&rev.ID, &rev.CreatedAt)
+	if err != nil {
+		return rev, err
+	}
+
+	err = addOutbox(ctx, tx, events.BalanceRefunded, map[string]interface{}{
+		"user_id":     rev.UserID,
+		"order":       number,
+		"amount":      sum,
+		"reversal_id": rev.ID,
+	})
+	if err != nil {
+		return rev, err
+	}
+
+	return rev, nil
+}
+
+func (db *DB) GetProcessingOrders(ctx context.Context) ([]string, error) {
 	var orders []string
 
 	query := `SELECT order_number FROM orders WHERE status = 'PROCESSING'`
-	rows, err := db.pool.Query(context.Background(), query)
+	rows, err := db.conn.Query(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -238,11 +492,11 @@ func (db *DB) GetProcessingOrders() ([]string, error) {
 	return orders, nil
 }
 
-func (db *DB) GetNewOrders() ([]string, error) {
+func (db *DB) GetNewOrders(ctx context.Context) ([]string, error) {
 	var orders []string
 
 	query := `UPDATE orders SET status = 'PROCESSING' WHERE status = 'NEW' RETURNING order_number`
-	rows, err := db.pool.Query(context.Background(), query)
+	rows, err := db.conn.Query(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -264,36 +518,127 @@ func (db *DB) GetNewOrders() ([]string, error) {
 	return orders, nil
 }
 
-func (db *DB) UpdateOrder(accrual storage.Accrual) (uint64, error) {
-	var result uint64
+// UpdateOrder stores the accrual result and reports the order owner and
+// whether the order status has changed. The owner is zero for unknown orders.
+func (db *DB) UpdateOrder(ctx context.Context, accrual storage.Accrual) (_ uint64, _ bool, err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
 
-	updateQuery := `UPDATE orders SET status = $1, accrual = $2 WHERE order_number = $3 RETURNING user_id`
-	rows, err := db.pool.Query(context.Background(), updateQuery, accrual.Status, accrual.Accrual, accrual.OrderNumber)
+	// lock the order to compare the stored status with the new one
+	var (
+		userID uint64
+		status string
+	)
+	selectQuery := `SELECT user_id, status FROM orders WHERE order_number = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, selectQuery, accrual.OrderNumber).Scan(&userID, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
 	if err != nil {
-		return 0, err
+		return 0, false, err
+	}
+
+	// final statuses are never overwritten, so repeated or late results are no-ops
+	if status == order.StatusProcessed || status == order.StatusInvalid {
+		return userID, false, nil
+	}
+
+	updateQuery := `UPDATE orders SET status = $1, accrual = $2 WHERE order_number = $3`
+	_, err = tx.Exec(ctx, updateQuery, accrual.Status, accrual.Accrual, accrual.OrderNumber)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// keep the history of status transitions only, not of every poll
+	if status != accrual.Status {
+		eventQuery := `INSERT INTO order_events (order_number, status, accrual) VALUES ($1, $2, $3)`
+		_, err = tx.Exec(ctx, eventQuery, accrual.OrderNumber, accrual.Status, accrual.Accrual)
+		if err != nil {
+			return 0, false, err
+		}
+
+		err = addOutbox(ctx, tx, events.OrderStatusChanged, map[string]interface{}{
+			"user_id": userID,
+			"order":   accrual.OrderNumber,
+			"status":  accrual.Status,
+			"accrual": accrual.Accrual,
+		})
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	return userID, status != accrual.Status, nil
+}
+
+func (db *DB) GetOrderEvents(ctx context.Context, number string) ([]storage.OrderEvent, error) {
+	var events []storage.OrderEvent
+
+	query := `SELECT status, accrual, created_at FROM order_events WHERE order_number = $1 ORDER BY created_at, id`
+	rows, err := db.conn.Query(ctx, query, number)
+	if err != nil {
+		return nil, err
 	}
 
 	err = rows.Err()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	for rows.Next() {
-		var o uint64
-		err = rows.Scan(&o)
+		var e storage.OrderEvent
+		err = rows.Scan(&e.Status, &e.Accrual, &e.CreatedAt)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		result = o
+		events = append(events, e)
 	}
 
-	return result, nil
+	return events, nil
 }
-func (db *DB) Accrual(userID uint64, acc float64) error {
+
+func (db *DB) Accrual(ctx context.Context, credit storage.Credit) (err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
 	updateQuery := `UPDATE accounts SET balance = balance + $1 WHERE user_id = $2`
-	_, err := db.pool.Exec(context.Background(), updateQuery, acc, userID)
+	_, err = tx.Exec(ctx, updateQuery, credit.Amount, credit.UserID)
+	if err != nil {
+		return err
+	}
+
+	err = addLot(ctx, tx, credit)
 	if err != nil {
 		return err
 	}
+
+	err = addOutbox(ctx, tx, events.BalanceAccrued, map[string]interface{}{
+		"user_id": credit.UserID,
+		"order":   credit.OrderNumber,
+		"amount":  credit.Amount,
+		"kind":    credit.Kind,
+	})
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,150 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// SetSignupInfo runs in a savepoint within a transaction, so the transaction
+// stays usable after a unique violation of the referral code.
+func (db *DB) SetSignupInfo(ctx context.Context, info storage.SignupInfo) (err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	query := `UPDATE users SET referral_code = $2, signup_ip = $3, signup_device = $4 WHERE id = $1`
+	_, err = tx.Exec(ctx, query, info.UserID, info.ReferralCode, info.IP, info.Device)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *DB) GetSignupInfo(ctx context.Context, userID uint64) (storage.SignupInfo, error) {
+	info := storage.SignupInfo{}
+
+	query := `SELECT id, COALESCE(referral_code, ''), signup_ip, signup_device FROM users WHERE id = $1`
+	err := db.conn.QueryRow(ctx, query, userID).Scan(&info.UserID, &info.ReferralCode, &info.IP, &info.Device)
+	if err != nil {
+		return info, err
+	}
+
+	return info, nil
+}
+
+func (db *DB) GetUserByReferralCode(ctx context.Context, code string) (storage.SignupInfo, error) {
+	info := storage.SignupInfo{}
+
+	query := `SELECT id, referral_code, signup_ip, signup_device FROM users WHERE referral_code = $1`
+	err := db.conn.QueryRow(ctx, query, code).Scan(&info.UserID, &info.ReferralCode, &info.IP, &info.Device)
+	if err != nil {
+		return info, err
+	}
+
+	return info, nil
+}
+
+func (db *DB) AddReferral(ctx context.Context, r storage.Referral) error {
+	query := `INSERT INTO referrals (referred_id, referrer_id, status, reason) VALUES ($1, $2, $3, $4)`
+	_, err := db.conn.Exec(ctx, query, r.ReferredID, r.ReferrerID, r.Status, r.Reason)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *DB) RewardReferral(ctx context.Context, referredID uint64, referrerBonus, referredBonus float64, maxRewarded int) (ref storage.Referral, ok bool, err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return ref, false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	query := `SELECT referrer_id, referred_id FROM referrals WHERE referred_id = $1 AND status = 'PENDING' FOR UPDATE`
+	err = tx.QueryRow(ctx, query, referredID).Scan(&ref.ReferrerID, &ref.ReferredID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ref, false, nil
+	}
+	if err != nil {
+		return ref, false, err
+	}
+
+	// the referrer account lock serializes rewards counted against the cap
+	_, err = tx.Exec(ctx, `SELECT 1 FROM accounts WHERE user_id = $1 FOR UPDATE`, ref.ReferrerID)
+	if err != nil {
+		return ref, false, err
+	}
+
+	var rewarded int
+	query = `SELECT COUNT(*) FROM referrals WHERE referrer_id = $1 AND status = 'REWARDED' AND referrer_bonus > 0`
+	err = tx.QueryRow(ctx, query, ref.ReferrerID).Scan(&rewarded)
+	if err != nil {
+		return ref, false, err
+	}
+
+	ref.ReferrerBonus = referrerBonus
+	if rewarded >= maxRewarded {
+		ref.ReferrerBonus = 0
+		ref.Reason = "referrer cap reached"
+	}
+	ref.ReferredBonus = referredBonus
+
+	query = `UPDATE referrals SET status = 'REWARDED', reason = $2, referrer_bonus = $3, referred_bonus = $4, rewarded_at = now()
+				WHERE referred_id = $1 RETURNING status, created_at, rewarded_at`
+	err = tx.QueryRow(ctx, query, referredID, ref.Reason, ref.ReferrerBonus, ref.ReferredBonus).
+		Scan(&ref.Status, &ref.CreatedAt, &ref.RewardedAt)
+	if err != nil {
+		return ref, false, err
+	}
+
+	return ref, true, nil
+}
+
+func (db *DB) GetReferrals(ctx context.Context, referrerID uint64) ([]storage.Referral, error) {
+	var result []storage.Referral
+
+	query := `SELECT r.referrer_id, r.referred_id, u.username, r.status, r.reason, r.referrer_bonus, r.referred_bonus,
+					r.created_at, r.rewarded_at
+				FROM referrals r JOIN users u ON u.id = r.referred_id
+				WHERE r.referrer_id = $1 ORDER BY r.created_at DESC`
+	rows, err := db.conn.Query(ctx, query, referrerID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var r storage.Referral
+		err = rows.Scan(&r.ReferrerID, &r.ReferredID, &r.Login, &r.Status, &r.Reason, &r.ReferrerBonus, &r.ReferredBonus,
+			&r.CreatedAt, &r.RewardedAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+
+	return result, nil
+}
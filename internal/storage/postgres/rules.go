@@ -0,0 +1,125 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// AddAccrualOrder stores the order metadata, replacing the previous version.
+func (db *DB) AddAccrualOrder(ctx context.Context, order storage.AccrualOrder) (err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	orderQuery := `INSERT INTO accrual_orders (order_number, total) VALUES ($1, $2)
+					ON CONFLICT (order_number) DO UPDATE SET total = $2`
+	_, err = tx.Exec(ctx, orderQuery, order.OrderNumber, order.Total)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM accrual_order_goods WHERE order_number = $1`, order.OrderNumber)
+	if err != nil {
+		return err
+	}
+
+	goodsQuery := `INSERT INTO accrual_order_goods (order_number, sku, brand, description, price, quantity)
+					VALUES ($1, $2, $3, $4, $5, $6)`
+	for _, g := range order.Goods {
+		_, err = tx.Exec(ctx, goodsQuery, order.OrderNumber, g.SKU, g.Brand, g.Description, g.Price, g.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) GetAccrualOrder(ctx context.Context, number string) (*storage.AccrualOrder, error) {
+	order := &storage.AccrualOrder{}
+
+	orderQuery := `SELECT order_number, total FROM accrual_orders WHERE order_number = $1`
+	err := db.conn.QueryRow(ctx, orderQuery, number).Scan(&order.OrderNumber, &order.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	goodsQuery := `SELECT sku, brand, description, price, quantity FROM accrual_order_goods
+					WHERE order_number = $1 ORDER BY id`
+	rows, err := db.conn.Query(ctx, goodsQuery, number)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var g storage.AccrualGood
+		err = rows.Scan(&g.SKU, &g.Brand, &g.Description, &g.Price, &g.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		order.Goods = append(order.Goods, g)
+	}
+
+	return order, nil
+}
+
+func (db *DB) AddAccrualRule(ctx context.Context, rule storage.AccrualRule) (uint64, error) {
+	var id uint64
+
+	query := `INSERT INTO accrual_rules (field, match, reward, reward_type) VALUES ($1, $2, $3, $4) RETURNING id`
+	err := db.conn.QueryRow(ctx, query, rule.Field, rule.Match, rule.Reward, rule.RewardType).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (db *DB) GetAccrualRules(ctx context.Context) ([]storage.AccrualRule, error) {
+	var rules []storage.AccrualRule
+
+	query := `SELECT id, field, match, reward, reward_type FROM accrual_rules ORDER BY id`
+	rows, err := db.conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var r storage.AccrualRule
+		err = rows.Scan(&r.ID, &r.Field, &r.Match, &r.Reward, &r.RewardType)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+func (db *DB) DeleteAccrualRule(ctx context.Context, id uint64) (bool, error) {
+	tag, err := db.conn.Exec(ctx, `DELETE FROM accrual_rules WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
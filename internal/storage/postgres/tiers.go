@@ -0,0 +1,137 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+func (db *DB) GetUserTier(ctx context.Context, userID uint64) (string, error) {
+	var tier string
+
+	err := db.conn.QueryRow(ctx, `SELECT tier FROM user_tiers WHERE user_id = $1`, userID).Scan(&tier)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return tier, nil
+}
+
+// tierStatsColumns selects the stats of the users row u since $1.
+const tierStatsColumns = `u.id,
+					(SELECT COALESCE(SUM(l.amount), 0) FROM point_ledger l
+						WHERE l.user_id = u.id AND l.kind = 'ACCRUAL' AND l.created_at >= $1),
+					(SELECT COUNT(DISTINCT e.order_number) FROM order_events e
+						JOIN orders o ON o.order_number = e.order_number
+						WHERE o.user_id = u.id AND e.status = 'PROCESSED' AND e.created_at >= $1)`
+
+func (db *DB) GetTierStats(ctx context.Context, since time.Time, afterUserID uint64, limit int) ([]storage.TierStats, error) {
+	var result []storage.TierStats
+
+	query := `SELECT ` + tierStatsColumns + ` FROM users u WHERE u.id > $2 ORDER BY u.id LIMIT $3`
+	rows, err := db.conn.Query(ctx, query, since, afterUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var st storage.TierStats
+		err = rows.Scan(&st.UserID, &st.Points, &st.Orders)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, st)
+	}
+
+	return result, nil
+}
+
+func (db *DB) GetUserTierStats(ctx context.Context, userID uint64, since time.Time) (storage.TierStats, error) {
+	var st storage.TierStats
+
+	query := `SELECT ` + tierStatsColumns + ` FROM users u WHERE u.id = $2`
+	err := db.conn.QueryRow(ctx, query, since, userID).Scan(&st.UserID, &st.Points, &st.Orders)
+	if err != nil {
+		return st, err
+	}
+
+	return st, nil
+}
+
+func (db *DB) SetUserTier(ctx context.Context, stats storage.TierStats, tier string) (changed bool, err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	var previous string
+	err = tx.QueryRow(ctx, `SELECT tier FROM user_tiers WHERE user_id = $1 FOR UPDATE`, stats.UserID).Scan(&previous)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return false, err
+	}
+
+	query := `INSERT INTO user_tiers (user_id, tier, points, orders) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (user_id) DO UPDATE
+					SET tier = EXCLUDED.tier, points = EXCLUDED.points, orders = EXCLUDED.orders, updated_at = now()`
+	_, err = tx.Exec(ctx, query, stats.UserID, tier, stats.Points, stats.Orders)
+	if err != nil {
+		return false, err
+	}
+
+	if tier == previous {
+		return false, nil
+	}
+
+	query = `INSERT INTO tier_history (user_id, tier, previous_tier, points, orders) VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(ctx, query, stats.UserID, tier, previous, stats.Points, stats.Orders)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (db *DB) GetTierHistory(ctx context.Context, userID uint64) ([]storage.TierChange, error) {
+	var result []storage.TierChange
+
+	query := `SELECT tier, previous_tier, points, orders, changed_at FROM tier_history
+				WHERE user_id = $1 ORDER BY changed_at DESC`
+	rows, err := db.conn.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var c storage.TierChange
+		err = rows.Scan(&c.Tier, &c.PreviousTier, &c.Points, &c.Orders, &c.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedQuerier starts a client span for every statement of the wrapped querier.
+// Transactions begun through it are traced too.
+type tracedQuerier struct {
+	querier
+}
+
+func (q tracedQuerier) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := q.querier.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tracedTx{Tx: tx}, nil
+}
+
+func (q tracedQuerier) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return traceExec(ctx, q.querier, sql, args...)
+}
+
+func (q tracedQuerier) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return traceQuery(ctx, q.querier, sql, args...)
+}
+
+func (q tracedQuerier) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return traceQueryRow(ctx, q.querier, sql, args...)
+}
+
+type tracedTx struct {
+	pgx.Tx
+}
+
+func (t tracedTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := t.Tx.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tracedTx{Tx: tx}, nil
+}
+
+func (t tracedTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return traceExec(ctx, t.Tx, sql, args...)
+}
+
+func (t tracedTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return traceQuery(ctx, t.Tx, sql, args...)
+}
+
+func (t tracedTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return traceQueryRow(ctx, t.Tx, sql, args...)
+}
+
+func startSpan(ctx context.Context, sql string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "pgx.query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatementKey.String(sql),
+		),
+	)
+}
+
+func traceExec(ctx context.Context, q querier, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, span := startSpan(ctx, sql)
+	defer span.End()
+
+	tag, err := q.Exec(ctx, sql, args...)
+	if err != nil {
+		tracing.Fail(span, err)
+	}
+	return tag, err
+}
+
+func traceQuery(ctx context.Context, q querier, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, span := startSpan(ctx, sql)
+
+	rows, err := q.Query(ctx, sql, args...)
+	if err != nil {
+		tracing.Fail(span, err)
+		span.End()
+		return nil, err
+	}
+	return &tracedRows{Rows: rows, span: span}, nil
+}
+
+func traceQueryRow(ctx context.Context, q querier, sql string, args ...interface{}) pgx.Row {
+	ctx, span := startSpan(ctx, sql)
+	return tracedRow{row: q.QueryRow(ctx, sql, args...), span: span}
+}
+
+// tracedRows ends the query span once the result set is read or closed.
+type tracedRows struct {
+	pgx.Rows
+	span trace.Span
+}
+
+func (r *tracedRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.end()
+	return false
+}
+
+func (r *tracedRows) Close() {
+	r.Rows.Close()
+	r.end()
+}
+
+func (r *tracedRows) end() {
+	if err := r.Rows.Err(); err != nil {
+		tracing.Fail(r.span, err)
+	}
+	r.span.End()
+}
+
+// tracedRow ends the query span on Scan, when the single row query is executed.
+type tracedRow struct {
+	row  pgx.Row
+	span trace.Span
+}
+
+func (r tracedRow) Scan(dest ...interface{}) error {
+	defer r.span.End()
+
+	err := r.row.Scan(dest...)
+	if err != nil && err != pgx.ErrNoRows {
+		tracing.Fail(r.span, err)
+	}
+	return err
+}
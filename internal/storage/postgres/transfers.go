@@ -0,0 +1,226 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/moorzeen/loyalty-service/internal/events"
+	"github.com/moorzeen/loyalty-service/internal/order"
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+func (db *DB) Transfer(ctx context.Context, senderID uint64, recipient string, sum float64) (t storage.Transfer, err error) {
+	t = storage.Transfer{Direction: "OUT", Counterparty: recipient, Sum: sum}
+
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return t, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	err = tx.QueryRow(ctx, `SELECT id FROM users WHERE username = $1`, recipient).Scan(&t.CounterpartyID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = order.ErrRecipientNotFound
+		return t, err
+	}
+	if err != nil {
+		return t, err
+	}
+	if t.CounterpartyID == senderID {
+		err = order.ErrSelfTransfer
+		return t, err
+	}
+
+	// users signed up before accounts were created atomically may have none
+	query := `INSERT INTO accounts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`
+	_, err = tx.Exec(ctx, query, t.CounterpartyID)
+	if err != nil {
+		return t, err
+	}
+
+	// both accounts are locked in the user ID order, so opposite transfers can't deadlock
+	query = `SELECT user_id, balance, ` + heldSum + ` FROM accounts
+				WHERE user_id = ANY($1) ORDER BY user_id FOR UPDATE`
+	rows, err := tx.Query(ctx, query, []int64{int64(senderID), int64(t.CounterpartyID)})
+	if err != nil {
+		return t, err
+	}
+	var (
+		balance, held float64
+		locked        int
+	)
+	for rows.Next() {
+		var (
+			userID        uint64
+			total, onHold float64
+		)
+		err = rows.Scan(&userID, &total, &onHold)
+		if err != nil {
+			rows.Close()
+			return t, err
+		}
+		if userID == senderID {
+			balance, held = total, onHold
+		}
+		locked++
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return t, err
+	}
+	if locked != 2 {
+		err = fmt.Errorf("account of user %d not found", senderID)
+		return t, err
+	}
+
+	// points on hold are reserved
+	if sum > balance-held {
+		err = order.ErrInsufficientFunds
+		return t, err
+	}
+
+	var (
+		limits    storage.TransferLimits
+		sentSum   float64
+		sentCount int
+	)
+	err = tx.QueryRow(ctx, `SELECT daily_sum, daily_count, updated_at FROM transfer_limits`).
+		Scan(&limits.DailySum, &limits.DailyCount, &limits.UpdatedAt)
+	if err != nil {
+		return t, err
+	}
+	query = `SELECT COALESCE(SUM(sum), 0), COUNT(*) FROM transfers
+				WHERE sender_id = $1 AND created_at >= date_trunc('day', now())`
+	err = tx.QueryRow(ctx, query, senderID).Scan(&sentSum, &sentCount)
+	if err != nil {
+		return t, err
+	}
+	if (limits.DailySum > 0 && sentSum+sum > limits.DailySum) || (limits.DailyCount > 0 && sentCount >= limits.DailyCount) {
+		err = order.ErrTransferLimit
+		return t, err
+	}
+
+	query = `INSERT INTO transfers (sender_id, recipient_id, sum) VALUES ($1, $2, $3) RETURNING id, created_at`
+	err = tx.QueryRow(ctx, query, senderID, t.CounterpartyID, sum).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return t, err
+	}
+
+	tag, err := tx.Exec(ctx, `UPDATE accounts SET balance = balance - $1 WHERE user_id = $2`, sum, senderID)
+	if err != nil {
+		return t, err
+	}
+	if tag.RowsAffected() != 1 {
+		err = fmt.Errorf("account of user %d not found", senderID)
+		return t, err
+	}
+	tag, err = tx.Exec(ctx, `UPDATE accounts SET balance = balance + $1 WHERE user_id = $2`, sum, t.CounterpartyID)
+	if err != nil {
+		return t, err
+	}
+	if tag.RowsAffected() != 1 {
+		err = fmt.Errorf("account of user %d not found", t.CounterpartyID)
+		return t, err
+	}
+
+	// every sent part is received as a lot with the same expiry, so points
+	// can't be passed around to renew them
+	parts, err := takeLots(ctx, tx, senderID, sum)
+	if err != nil {
+		return t, err
+	}
+	err = debitLots(ctx, tx, parts, storage.LedgerTransferOut, "", t.ID)
+	if err != nil {
+		return t, err
+	}
+	for _, p := range parts {
+		err = addLot(ctx, tx, storage.Credit{
+			UserID:     t.CounterpartyID,
+			Kind:       storage.LedgerTransferIn,
+			Amount:     p.remaining,
+			ExpiresAt:  p.expiresAt,
+			TransferID: t.ID,
+		})
+		if err != nil {
+			return t, err
+		}
+	}
+
+	err = addOutbox(ctx, tx, events.BalanceTransferred, map[string]interface{}{
+		"transfer_id":  t.ID,
+		"sender_id":    senderID,
+		"recipient_id": t.CounterpartyID,
+		"amount":       sum,
+	})
+	if err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+func (db *DB) GetTransfers(ctx context.Context, userID uint64, hq storage.HistoryQuery) ([]storage.Transfer, error) {
+	var result []storage.Transfer
+
+	// order_number is the cursor key of the history clause, see storage.TransferKey
+	hq.Statuses = nil
+	clause, args := historyClause(hq, "created_at", []interface{}{userID})
+	query := `SELECT id, direction, counterparty_id, counterparty, sum, created_at FROM (
+					SELECT t.id, lpad(t.id::text, 20, '0') AS order_number, 'OUT' AS direction,
+						t.recipient_id AS counterparty_id, u.username AS counterparty, t.sum, t.created_at
+					FROM transfers t JOIN users u ON u.id = t.recipient_id WHERE t.sender_id = $1
+					UNION ALL
+					SELECT t.id, lpad(t.id::text, 20, '0'), 'IN', t.sender_id, u.username, t.sum, t.created_at
+					FROM transfers t JOIN users u ON u.id = t.sender_id WHERE t.recipient_id = $1
+				) h WHERE true` + clause
+	rows, err := db.conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var t storage.Transfer
+		err = rows.Scan(&t.ID, &t.Direction, &t.CounterpartyID, &t.Counterparty, &t.Sum, &t.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+
+	return result, nil
+}
+
+func (db *DB) GetTransferLimits(ctx context.Context) (storage.TransferLimits, error) {
+	var limits storage.TransferLimits
+
+	query := `SELECT daily_sum, daily_count, updated_at FROM transfer_limits`
+	err := db.conn.QueryRow(ctx, query).Scan(&limits.DailySum, &limits.DailyCount, &limits.UpdatedAt)
+	if err != nil {
+		return limits, err
+	}
+
+	return limits, nil
+}
+
+func (db *DB) SetTransferLimits(ctx context.Context, limits storage.TransferLimits) (storage.TransferLimits, error) {
+	query := `UPDATE transfer_limits SET daily_sum = $1, daily_count = $2, updated_at = now() RETURNING updated_at`
+	err := db.conn.QueryRow(ctx, query, limits.DailySum, limits.DailyCount).Scan(&limits.UpdatedAt)
+	if err != nil {
+		return limits, err
+	}
+
+	return limits, nil
+}
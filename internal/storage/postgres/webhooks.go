@@ -0,0 +1,160 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+func (db *DB) AddWebhook(ctx context.Context, hook storage.Webhook) (uint64, error) {
+	var id uint64
+
+	query := `INSERT INTO webhooks (user_id, url, secret, event_types) VALUES ($1, $2, $3, $4) RETURNING id`
+	err := db.conn.QueryRow(ctx, query, hook.UserID, hook.URL, hook.Secret, hook.EventTypes).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (db *DB) GetWebhooks(ctx context.Context, userID uint64) ([]storage.Webhook, error) {
+	var hooks []storage.Webhook
+
+	query := `SELECT id, user_id, url, event_types, created_at FROM webhooks WHERE user_id = $1 ORDER BY id`
+	rows, err := db.conn.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var h storage.Webhook
+		err = rows.Scan(&h.ID, &h.UserID, &h.URL, &h.EventTypes, &h.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+
+	return hooks, nil
+}
+
+func (db *DB) DeleteWebhook(ctx context.Context, userID uint64, id uint64) (bool, error) {
+	query := `DELETE FROM webhooks WHERE id = $1 AND user_id = $2`
+	tag, err := db.conn.Exec(ctx, query, id, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (db *DB) GetWebhookDeliveries(ctx context.Context, userID uint64, id uint64, limit int) ([]storage.WebhookDelivery, error) {
+	var result []storage.WebhookDelivery
+
+	query := `SELECT d.outbox_id, o.event_type, d.attempt, d.status_code, d.error, d.attempted_at
+				FROM webhook_deliveries d
+				JOIN webhook_outbox o ON o.id = d.outbox_id
+				JOIN webhooks w ON w.id = o.webhook_id
+				WHERE w.id = $1 AND w.user_id = $2
+				ORDER BY d.id DESC LIMIT $3`
+	rows, err := db.conn.Query(ctx, query, id, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var d storage.WebhookDelivery
+		err = rows.Scan(&d.OutboxID, &d.EventType, &d.Attempt, &d.StatusCode, &d.Error, &d.AttemptedAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+
+	return result, nil
+}
+
+// ClaimWebhookMessages takes due outbox entries and postpones them by lease,
+// so they are retried if the claiming worker dies before completing them.
+// SKIP LOCKED lets several replicas claim entries concurrently.
+func (db *DB) ClaimWebhookMessages(ctx context.Context, limit int, lease time.Duration) ([]storage.WebhookMessage, error) {
+	var result []storage.WebhookMessage
+
+	query := `UPDATE webhook_outbox o SET next_attempt_at = now() + $2 * interval '1 millisecond'
+				FROM webhooks w
+				WHERE w.id = o.webhook_id AND o.id IN (
+					SELECT id FROM webhook_outbox
+					WHERE status = 'PENDING' AND next_attempt_at <= now()
+					ORDER BY next_attempt_at
+					LIMIT $1
+					FOR UPDATE SKIP LOCKED
+				)
+				RETURNING o.id, o.webhook_id, w.url, w.secret, o.event_type, o.payload::text, o.attempts`
+	rows, err := db.conn.Query(ctx, query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var (
+			m       storage.WebhookMessage
+			payload string
+		)
+		err = rows.Scan(&m.ID, &m.WebhookID, &m.URL, &m.Secret, &m.EventType, &payload, &m.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		m.Payload = []byte(payload)
+		result = append(result, m)
+	}
+
+	return result, nil
+}
+
+// CompleteWebhookMessage logs the delivery attempt and sets the outbox entry
+// status and the time of its next attempt.
+func (db *DB) CompleteWebhookMessage(ctx context.Context, delivery storage.WebhookDelivery,
+	status string, retryAt time.Time) (err error) {
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	logQuery := `INSERT INTO webhook_deliveries (outbox_id, attempt, status_code, error) VALUES ($1, $2, $3, $4)`
+	_, err = tx.Exec(ctx, logQuery, delivery.OutboxID, delivery.Attempt, delivery.StatusCode, delivery.Error)
+	if err != nil {
+		return err
+	}
+
+	updateQuery := `UPDATE webhook_outbox SET status = $1, attempts = $2, next_attempt_at = $3 WHERE id = $4`
+	_, err = tx.Exec(ctx, updateQuery, status, delivery.Attempt, retryAt, delivery.OutboxID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
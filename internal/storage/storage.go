@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"time"
 )
 
@@ -11,6 +12,28 @@ type User struct {
 	PasswordHash []byte
 }
 
+// SignupInfo is the referral code of a user and where the user signed up from.
+type SignupInfo struct {
+	UserID       uint64
+	ReferralCode string
+	IP           string
+	Device       string
+}
+
+// Referral of a user by another one, both rewarded on the first processed
+// order of the referred user.
+type Referral struct {
+	ReferrerID    uint64     `json:"-"`
+	ReferredID    uint64     `json:"-"`
+	Login         string     `json:"login"` // of the referred user, masked
+	Status        string     `json:"status"`
+	Reason        string     `json:"reason,omitempty"`
+	ReferrerBonus float64    `json:"bonus"`
+	ReferredBonus float64    `json:"-"`
+	CreatedAt     time.Time  `json:"created_at"`
+	RewardedAt    *time.Time `json:"rewarded_at,omitempty"`
+}
+
 type Session struct {
 	UserID  uint64
 	SignKey []byte
@@ -22,6 +45,56 @@ type Accrual struct {
 	Accrual     float64 `json:"accrual"`
 }
 
+// AccrualOrder is the order metadata used by the local accrual rules engine.
+type AccrualOrder struct {
+	OrderNumber string        `json:"order"`
+	Total       float64       `json:"total"`
+	Goods       []AccrualGood `json:"goods"`
+}
+
+type AccrualGood struct {
+	SKU         string  `json:"sku"`
+	Brand       string  `json:"brand"`
+	Description string  `json:"description"`
+	Price       float64 `json:"price"`
+	Quantity    int     `json:"quantity"`
+}
+
+// AccrualRule rewards goods whose Field matches the Match pattern, or the
+// order total when Field is "order". RewardType is "%" of the price or "pt"
+// fixed points per unit.
+type AccrualRule struct {
+	ID         uint64  `json:"id,omitempty" yaml:"-"`
+	Field      string  `json:"field" yaml:"field"`
+	Match      string  `json:"match" yaml:"match"`
+	Reward     float64 `json:"reward" yaml:"reward"`
+	RewardType string  `json:"reward_type" yaml:"reward_type"`
+}
+
+// Campaign grants bonus points for orders processed between StartsAt and
+// EndsAt to eligible users. Effect is "multiplier" of the order accrual or
+// "fixed" points per order.
+type Campaign struct {
+	ID          uint64    `json:"id,omitempty"`
+	Name        string    `json:"name"`
+	StartsAt    time.Time `json:"starts_at"`
+	EndsAt      time.Time `json:"ends_at"`
+	NewUserDays int       `json:"new_user_days,omitempty"` // registered within, zero for any user
+	Tiers       []string  `json:"tiers,omitempty"`
+	MinOrders   int       `json:"min_orders,omitempty"` // processed orders including the current one
+	MaxOrders   int       `json:"max_orders,omitempty"`
+	Effect      string    `json:"effect"`
+	Value       float64   `json:"value"`
+	Awarded     float64   `json:"awarded"` // bonus points credited so far
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// UserStats is what campaign eligibility depends on.
+type UserStats struct {
+	RegisteredAt    time.Time
+	ProcessedOrders int
+}
+
 type Order struct {
 	OrderNumber string
 	UserID      uint64
@@ -30,28 +103,322 @@ type Order struct {
 	Accrual     float64
 }
 
+// AddedOrder is the outcome of a batch insert for one order number. When the
+// number was already taken, UserID is the user who added it first.
+type AddedOrder struct {
+	OrderNumber string
+	UserID      uint64
+	Added       bool
+}
+
+// OrderEvent is an order status transition observed by the accrual poller.
+type OrderEvent struct {
+	Status    string
+	Accrual   float64
+	CreatedAt time.Time
+}
+
 type Withdrawal struct {
 	OrderNumber string
 	Sum         float64
+	Reversed    float64 // returned to the balance by reversals
 	ProcessedAt time.Time
 }
 
-type Service interface {
+// WithdrawalReversal returns a part or all of a withdrawal to the balance.
+type WithdrawalReversal struct {
+	ID          uint64    `json:"id"`
+	UserID      uint64    `json:"-"`
+	OrderNumber string    `json:"order"`
+	Sum         float64   `json:"sum"`
+	Reason      string    `json:"reason,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type Webhook struct {
+	ID         uint64
+	UserID     uint64
+	URL        string
+	Secret     []byte
+	EventTypes []string
+	CreatedAt  time.Time
+}
+
+// WebhookMessage is an outbox entry claimed for delivery.
+type WebhookMessage struct {
+	ID        uint64
+	WebhookID uint64
+	URL       string
+	Secret    []byte
+	EventType string
+	Payload   []byte
+	Attempts  int
+}
+
+// WebhookDelivery is a logged delivery attempt.
+type WebhookDelivery struct {
+	OutboxID    uint64
+	EventType   string
+	Attempt     int
+	StatusCode  int
+	Error       string
+	AttemptedAt time.Time
+}
+
+// OutboxMessage is a state change event written in the same transaction as the change.
+type OutboxMessage struct {
+	ID        uint64
+	Type      string
+	Payload   []byte
+	CreatedAt time.Time
+}
+
+// point ledger entry kinds
+const (
+	LedgerAccrual     = "ACCRUAL"
+	LedgerReversal    = "REVERSAL"
+	LedgerWithdrawal  = "WITHDRAWAL"
+	LedgerExpiry      = "EXPIRY"
+	LedgerTierBonus   = "TIER_BONUS"
+	LedgerCampaign    = "CAMPAIGN"
+	LedgerReferral    = "REFERRAL"
+	LedgerTransferOut = "TRANSFER_OUT"
+	LedgerTransferIn  = "TRANSFER_IN"
+)
+
+// Credit adds points to the balance as a lot that is spent by expiry first
+// and expires at ExpiresAt, never when it is zero.
+type Credit struct {
+	UserID      uint64
+	Kind        string
+	OrderNumber string
+	Amount      float64
+	ExpiresAt   time.Time
+	CampaignID  uint64 // campaign bonuses only
+	TransferID  uint64 // received transfers only
+}
+
+// Expiration is the amount of points expiring at a time.
+type Expiration struct {
+	Amount    float64   `json:"amount"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ExpiredPoints is the amount of points of a user expired by ExpirePoints.
+type ExpiredPoints struct {
+	UserID uint64
+	Amount float64
+}
+
+// TierStats is the activity of a user within the tier window.
+type TierStats struct {
+	UserID uint64
+	Points float64 // accrued for processed orders, bonuses excluded
+	Orders int     // processed
+}
+
+// TierChange is an entry of the user tier history.
+type TierChange struct {
+	Tier         string    `json:"tier"`
+	PreviousTier string    `json:"previous_tier"`
+	Points       float64   `json:"points"`
+	Orders       int       `json:"orders"`
+	ChangedAt    time.Time `json:"changed_at"`
+}
+
+// Balance of a user account. Current excludes the points reserved by active holds.
+type Balance struct {
+	Current   float64
+	Withdrawn float64
+	Held      float64
+}
+
+// Hold reserves points for a purchase until it is captured as a withdrawal,
+// released or expired.
+type Hold struct {
+	ID          uint64     `json:"id"`
+	UserID      uint64     `json:"-"`
+	OrderNumber string     `json:"order"`
+	Sum         float64    `json:"sum"`
+	Captured    float64    `json:"captured,omitempty"`
+	Status      string     `json:"status"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	SettledAt   *time.Time `json:"settled_at,omitempty"`
+}
+
+// IdempotencyKey is a client key of a request and the response stored for
+// its retries. StatusCode is zero while the first request is in progress.
+type IdempotencyKey struct {
+	UserID      uint64
+	Key         string
+	RequestHash []byte
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// Transfer of points between users, as seen by one of them.
+type Transfer struct {
+	ID             uint64    `json:"id"`
+	Direction      string    `json:"direction"` // "IN" or "OUT"
+	CounterpartyID uint64    `json:"-"`
+	Counterparty   string    `json:"login"`
+	Sum            float64   `json:"sum"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// TransferKey is the history cursor key of a transfer, it sorts like the ID.
+func TransferKey(id uint64) string {
+	return fmt.Sprintf("%020d", id)
+}
+
+// TransferLimits cap the daily transfers of a sender, zero means no limit.
+type TransferLimits struct {
+	DailySum   float64   `json:"daily_sum"`
+	DailyCount int       `json:"daily_count"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// HistoryQuery filters and pages a user's orders or withdrawals. Rows are
+// sorted by time and then by order number, the same pair forms the cursor.
+type HistoryQuery struct {
+	Statuses []string  // orders only, empty means any status
+	From     time.Time // inclusive, zero means unbounded
+	To       time.Time // exclusive, zero means unbounded
+	Desc     bool
+	After    *Cursor // nil starts from the first row
+	Limit    int     // zero means no limit
+}
+
+// Cursor points to the last row of the previous page.
+type Cursor struct {
+	Time        time.Time
+	OrderNumber string
+}
+
+// Tx is the set of storage operations. It is implemented both by the storage
+// itself and by the transaction handle passed to Service.WithTx.
+type Tx interface {
 	AddUser(ctx context.Context, username string, passwordHash []byte) (uint64, error)
 	AddAccount(ctx context.Context, userID uint64) error
 	GetUser(ctx context.Context, username string) (*User, error)
+	// SetSignupInfo stores the referral code and the sign up client of the user.
+	// A failure, such as a taken code, leaves the transaction usable.
+	SetSignupInfo(ctx context.Context, info SignupInfo) error
+	GetSignupInfo(ctx context.Context, userID uint64) (SignupInfo, error)
+	GetUserByReferralCode(ctx context.Context, code string) (SignupInfo, error)
 	SetSession(ctx context.Context, userID uint64, signKey []byte) error
 	GetSession(ctx context.Context, userID uint64) (*Session, error)
 
 	AddOrder(ctx context.Context, number string, userID uint64) error
+	AddOrders(ctx context.Context, numbers []string, userID uint64) ([]AddedOrder, error)
 	GetOrder(ctx context.Context, number string) (*Order, error)
-	GetOrders(ctx context.Context, userID uint64) ([]Order, error)
-	GetBalance(ctx context.Context, userID uint64) (float64, float64, error)
+	GetOrders(ctx context.Context, userID uint64, query HistoryQuery) ([]Order, error)
+	GetOrderEvents(ctx context.Context, number string) ([]OrderEvent, error)
+	GetBalance(ctx context.Context, userID uint64) (Balance, error)
 	Withdraw(ctx context.Context, userID uint64, number string, wth float64) error
-	GetWithdrawals(ctx context.Context, userID uint64) ([]Withdrawal, error)
+	GetWithdrawals(ctx context.Context, userID uint64, query HistoryQuery) ([]Withdrawal, error)
+	// ReverseWithdrawal returns sum of the withdrawal to the balance,
+	// a zero sum reverses the whole remainder.
+	ReverseWithdrawal(ctx context.Context, orderNumber string, sum float64, reason string, expiresAt time.Time) (WithdrawalReversal, error)
+
+	// Transfer moves sum from the sender to the recipient login within the
+	// transfer limits. The credited points keep the expiry of the sent ones.
+	Transfer(ctx context.Context, senderID uint64, recipient string, sum float64) (Transfer, error)
+	// GetTransfers returns the transfers sent and received by the user.
+	GetTransfers(ctx context.Context, userID uint64, query HistoryQuery) ([]Transfer, error)
+	GetTransferLimits(ctx context.Context) (TransferLimits, error)
+	SetTransferLimits(ctx context.Context, limits TransferLimits) (TransferLimits, error)
+
+	// GetExpirations returns the upcoming expirations of the user points, soonest first.
+	GetExpirations(ctx context.Context, userID uint64, limit int) ([]Expiration, error)
+	// ExpirePoints writes off the points of up to users users whose lots expired before.
+	ExpirePoints(ctx context.Context, before time.Time, users int) ([]ExpiredPoints, error)
+
+	// GetUserTier returns the current tier of the user, empty if none.
+	GetUserTier(ctx context.Context, userID uint64) (string, error)
+	// GetTierStats returns the stats since the time of up to limit users
+	// with IDs above afterUserID.
+	GetTierStats(ctx context.Context, since time.Time, afterUserID uint64, limit int) ([]TierStats, error)
+	// GetUserTierStats returns the stats of the user since the time.
+	GetUserTierStats(ctx context.Context, userID uint64, since time.Time) (TierStats, error)
+	// SetUserTier stores the tier and its stats, adding a history entry when the tier changes.
+	SetUserTier(ctx context.Context, stats TierStats, tier string) (bool, error)
+	GetTierHistory(ctx context.Context, userID uint64) ([]TierChange, error)
+
+	// AddHold reserves points of the available balance.
+	AddHold(ctx context.Context, hold Hold) (Hold, error)
+	GetHold(ctx context.Context, userID uint64, id uint64) (Hold, error)
+	// CaptureHold withdraws sum of the active hold, a zero sum captures all of it.
+	CaptureHold(ctx context.Context, userID uint64, id uint64, sum float64) (Hold, error)
+	ReleaseHold(ctx context.Context, userID uint64, id uint64) (Hold, error)
+	// ExpireHolds marks the active holds past their expiry as expired.
+	ExpireHolds(ctx context.Context) ([]Hold, error)
+
+	AddWebhook(ctx context.Context, hook Webhook) (uint64, error)
+	GetWebhooks(ctx context.Context, userID uint64) ([]Webhook, error)
+	DeleteWebhook(ctx context.Context, userID uint64, id uint64) (bool, error)
+	GetWebhookDeliveries(ctx context.Context, userID uint64, id uint64, limit int) ([]WebhookDelivery, error)
+	ClaimWebhookMessages(ctx context.Context, limit int, lease time.Duration) ([]WebhookMessage, error)
+	CompleteWebhookMessage(ctx context.Context, delivery WebhookDelivery, status string, retryAt time.Time) error
+
+	GetOutbox(ctx context.Context, limit int) ([]OutboxMessage, error)
+	MarkOutboxPublished(ctx context.Context, ids []uint64) error
+	// PurgeOutbox deletes messages published before the time, and with
+	// unpublished also the unpublished ones created before it.
+	PurgeOutbox(ctx context.Context, before time.Time, unpublished bool) (int64, error)
+
+	// ClaimIdempotencyKey stores the key unless it is already stored and
+	// created after expiredBefore, or claimed after leasedBefore and still
+	// without a response; then the stored key is returned unclaimed.
+	ClaimIdempotencyKey(ctx context.Context, key IdempotencyKey, expiredBefore, leasedBefore time.Time) (IdempotencyKey, bool, error)
+	SaveIdempotencyResponse(ctx context.Context, key IdempotencyKey) error
+	DeleteIdempotencyKey(ctx context.Context, userID uint64, key string) error
+	PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int64, error)
+
+	AddAccrualOrder(ctx context.Context, order AccrualOrder) error
+	GetAccrualOrder(ctx context.Context, number string) (*AccrualOrder, error)
+	AddAccrualRule(ctx context.Context, rule AccrualRule) (uint64, error)
+	GetAccrualRules(ctx context.Context) ([]AccrualRule, error)
+	DeleteAccrualRule(ctx context.Context, id uint64) (bool, error)
+
+	AddCampaign(ctx context.Context, campaign Campaign) (uint64, error)
+	GetCampaigns(ctx context.Context) ([]Campaign, error)
+	// GetActiveCampaigns returns the campaigns running at the time.
+	GetActiveCampaigns(ctx context.Context, at time.Time) ([]Campaign, error)
+	// EndCampaign ends a running or upcoming campaign now.
+	EndCampaign(ctx context.Context, id uint64) (bool, error)
+	// GetUserStats locks the account of the user and returns the user stats.
+	// In a transaction the lock serializes the stats of concurrent accruals.
+	GetUserStats(ctx context.Context, userID uint64) (UserStats, error)
+
+	AddReferral(ctx context.Context, referral Referral) error
+	// RewardReferral sets the bonuses of the pending referral of the user and
+	// marks it rewarded. The referrer bonus is zero once the referrer has
+	// maxRewarded rewarded referrals. It reports false when there is no
+	// pending referral.
+	RewardReferral(ctx context.Context, referredID uint64, referrerBonus, referredBonus float64, maxRewarded int) (Referral, bool, error)
+	GetReferrals(ctx context.Context, referrerID uint64) ([]Referral, error)
+
+	GetProcessingOrders(ctx context.Context) ([]string, error)
+	GetNewOrders(ctx context.Context) ([]string, error)
+	UpdateOrder(ctx context.Context, accrual Accrual) (uint64, bool, error)
+	// Accrual credits the order accrual to the balance.
+	Accrual(ctx context.Context, credit Credit) error
+}
+
+type Service interface {
+	Tx
+
+	// WithTx runs fn in a single transaction. The transaction is committed when
+	// fn returns nil and rolled back otherwise.
+	WithTx(ctx context.Context, fn func(tx Tx) error) error
 
-	GetProcessingOrders() ([]string, error)
-	GetNewOrders() ([]string, error)
-	UpdateOrder(accrual Accrual) (uint64, error)
-	Accrual(userID uint64, acc float64) error
+	// Ping checks that the database is reachable.
+	Ping(ctx context.Context) error
+	// SchemaVersion returns the applied migration version and whether
+	// the last migration failed halfway.
+	SchemaVersion(ctx context.Context) (version uint, dirty bool, err error)
 }
@@ -0,0 +1,9 @@
+package tier
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidTiers = errors.New("invalid tier definitions")
+)
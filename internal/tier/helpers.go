@@ -0,0 +1,66 @@
+package tier
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseTiers parses comma-separated "name:min_points:min_orders:multiplier"
+// definitions, e.g. "Silver:1000:10:1.1,Gold:5000:50:1.25". The result is
+// ordered from the lowest tier to the highest.
+func ParseTiers(spec string) ([]Tier, error) {
+	var tiers []Tier
+
+	for _, def := range strings.Split(spec, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		parts := strings.Split(def, ":")
+		if len(parts) != 4 || parts[0] == "" {
+			return nil, fmt.Errorf("%w: \"%s\"", ErrInvalidTiers, def)
+		}
+
+		t := Tier{Name: parts[0]}
+		var err error
+		if t.MinPoints, err = strconv.ParseFloat(parts[1], 64); err != nil || t.MinPoints < 0 {
+			return nil, fmt.Errorf("%w: min points of \"%s\"", ErrInvalidTiers, def)
+		}
+		if t.MinOrders, err = strconv.Atoi(parts[2]); err != nil || t.MinOrders < 0 {
+			return nil, fmt.Errorf("%w: min orders of \"%s\"", ErrInvalidTiers, def)
+		}
+		if t.Multiplier, err = strconv.ParseFloat(parts[3], 64); err != nil || t.Multiplier < 1 {
+			return nil, fmt.Errorf("%w: multiplier of \"%s\"", ErrInvalidTiers, def)
+		}
+
+		tiers = append(tiers, t)
+	}
+
+	sort.SliceStable(tiers, func(i, j int) bool {
+		return tiers[i].MinPoints < tiers[j].MinPoints
+	})
+
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].Name == tiers[i-1].Name || tiers[i].MinOrders < tiers[i-1].MinOrders {
+			return nil, fmt.Errorf("%w: \"%s\" is not above \"%s\"", ErrInvalidTiers, tiers[i].Name, tiers[i-1].Name)
+		}
+	}
+
+	return tiers, nil
+}
+
+// round2 rounds the sum to hundredths, the precision of the balance.
+func round2(sum float64) float64 {
+	return math.Round(sum*100) / 100
+}
+
+// untilMidnight returns the time left to the next local midnight.
+func untilMidnight(now time.Time) time.Duration {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Sub(now)
+}
@@ -0,0 +1,193 @@
+package tier
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+const recalcBatch = 100
+
+// Tier is reached by accruing MinPoints or processing MinOrders within the
+// window. Accruals of its members are multiplied by Multiplier.
+type Tier struct {
+	Name       string
+	MinPoints  float64
+	MinOrders  int
+	Multiplier float64
+}
+
+// Progress is the user tier and what is left to the next one.
+type Progress struct {
+	Tier         string  `json:"tier,omitempty"`
+	Multiplier   float64 `json:"multiplier"`
+	Points       float64 `json:"points"`
+	Orders       int     `json:"orders"`
+	NextTier     string  `json:"next_tier,omitempty"`
+	PointsToNext float64 `json:"points_to_next,omitempty"`
+	OrdersToNext int     `json:"orders_to_next,omitempty"`
+}
+
+type Service struct {
+	storage storage.Service
+	tiers   []Tier
+	window  time.Duration
+	tick    *time.Ticker // Тикер ночного пересчета уровней
+}
+
+// NewService recalculates the user tiers now and then every night. With no
+// tiers the service is disabled.
+func NewService(str storage.Service, tiers []Tier, window time.Duration) Service {
+	s := Service{
+		storage: str,
+		tiers:   tiers,
+		window:  window,
+	}
+
+	if s.Enabled() {
+		s.tick = time.NewTicker(24 * time.Hour)
+		go s.recalculate()
+	}
+
+	return s
+}
+
+func (s *Service) Enabled() bool {
+	return len(s.tiers) > 0
+}
+
+// Bonuses credits the tier multiplier on top of the accrual, see accrual.Bonus.
+func (s *Service) Bonuses(ctx context.Context, tx storage.Tx, userID uint64, accrual storage.Accrual) ([]storage.Credit, error) {
+	if !s.Enabled() || accrual.Accrual <= 0 {
+		return nil, nil
+	}
+
+	name, err := tx.GetUserTier(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := s.find(name)
+	if !ok {
+		return nil, nil
+	}
+
+	extra := round2(accrual.Accrual * (t.Multiplier - 1))
+	if extra <= 0 {
+		return nil, nil
+	}
+
+	return []storage.Credit{{Kind: storage.LedgerTierBonus, Amount: extra}}, nil
+}
+
+// Progress returns the current tier of the user and the activity within the
+// window counted towards the next one.
+func (s *Service) Progress(ctx context.Context, userID uint64) (Progress, error) {
+	p := Progress{Multiplier: 1}
+
+	name, err := s.storage.GetUserTier(ctx, userID)
+	if err != nil {
+		return p, err
+	}
+
+	stats, err := s.storage.GetUserTierStats(ctx, userID, time.Now().Add(-s.window))
+	if err != nil {
+		return p, err
+	}
+	p.Points = stats.Points
+	p.Orders = stats.Orders
+
+	next := 0
+	if t, ok := s.find(name); ok {
+		p.Tier = t.Name
+		p.Multiplier = t.Multiplier
+		for i := range s.tiers {
+			if s.tiers[i].Name == t.Name {
+				next = i + 1
+			}
+		}
+	}
+
+	if next < len(s.tiers) {
+		t := s.tiers[next]
+		p.NextTier = t.Name
+		if p.Points < t.MinPoints {
+			p.PointsToNext = round2(t.MinPoints - p.Points)
+		}
+		if p.Orders < t.MinOrders {
+			p.OrdersToNext = t.MinOrders - p.Orders
+		}
+	}
+
+	return p, nil
+}
+
+func (s *Service) History(ctx context.Context, userID uint64) ([]storage.TierChange, error) {
+	return s.storage.GetTierHistory(ctx, userID)
+}
+
+// recalculate assigns the tiers at start and then at every midnight.
+func (s *Service) recalculate() {
+	s.recalculateAll()
+
+	time.Sleep(untilMidnight(time.Now()))
+	s.tick.Reset(24 * time.Hour)
+	s.recalculateAll()
+
+	for range s.tick.C {
+		s.recalculateAll()
+	}
+}
+
+func (s *Service) recalculateAll() {
+	ctx := context.Background()
+	since := time.Now().Add(-s.window)
+
+	var after uint64
+	for {
+		stats, err := s.storage.GetTierStats(ctx, since, after, recalcBatch)
+		if err != nil {
+			slog.Error("Failed to get tier stats", "error", err)
+			return
+		}
+
+		for _, st := range stats {
+			after = st.UserID
+			name := s.qualify(st)
+			changed, err := s.storage.SetUserTier(ctx, st, name)
+			if err != nil {
+				slog.Error("Failed to set user tier", "user_id", st.UserID, "error", err)
+				continue
+			}
+			if changed {
+				slog.Info("User tier changed", "user_id", st.UserID, "tier", name)
+			}
+		}
+
+		if len(stats) < recalcBatch {
+			return
+		}
+	}
+}
+
+// qualify returns the highest tier reached by points or by orders, empty if none.
+func (s *Service) qualify(st storage.TierStats) string {
+	name := ""
+	for _, t := range s.tiers {
+		if st.Points >= t.MinPoints || st.Orders >= t.MinOrders {
+			name = t.Name
+		}
+	}
+	return name
+}
+
+func (s *Service) find(name string) (Tier, bool) {
+	for _, t := range s.tiers {
+		if name != "" && t.Name == name {
+			return t, true
+		}
+	}
+	return Tier{}, false
+}
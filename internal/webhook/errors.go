@@ -0,0 +1,13 @@
+package webhook
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidURL       = errors.New("webhook URL must be an absolute http or https URL")
+	ErrPrivateAddress   = errors.New("webhook URL must resolve to public addresses")
+	ErrNoEventTypes     = errors.New("at least one event type is required")
+	ErrUnknownEventType = errors.New("unknown event type")
+	ErrWebhookNotFound  = errors.New("webhook not found")
+)
@@ -0,0 +1,206 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/events"
+)
+
+// sharedAddressSpace is the carrier-grade NAT range, private but not reported by IsPrivate.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// validateURL checks the webhook URL and that its host resolves to public addresses only.
+func validateURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return ErrInvalidURL
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrInvalidURL
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("%w: can't resolve %s", ErrInvalidURL, host)
+	}
+	for _, a := range addrs {
+		if !isPublicIP(a.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrPrivateAddress, host, a.IP)
+		}
+	}
+
+	return nil
+}
+
+// isPublicIP reports whether the address is routable on the internet, so
+// webhooks can't reach the loopback, private networks or cloud metadata.
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	switch {
+	case ip.IsLoopback(), ip.IsPrivate(), ip.IsUnspecified(),
+		ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(), ip.IsInterfaceLocalMulticast(), ip.IsMulticast():
+		return false
+	case sharedAddressSpace.Contains(ip):
+		return false
+	}
+
+	return true
+}
+
+// publicOnly is the dialer Control that refuses non-public addresses. It
+// checks the address actually dialed, so DNS rebinding after the URL was
+// validated and redirects to internal hosts are refused as well.
+func publicOnly(_ string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+
+	return nil
+}
+
+func isEventType(s string) bool {
+	switch s {
+	case OrderProcessed, OrderInvalid, BalanceWithdrawn, BalanceRefunded, BalanceTransferred:
+		return true
+	default:
+		return false
+	}
+}
+
+// Target is a webhook event of an outbox message for the webhooks of a user.
+type Target struct {
+	UserID    uint64
+	EventType string
+	Payload   []byte
+}
+
+// Targets maps an outbox message to the webhook events of the users it
+// concerns. Messages of other types have no targets.
+func Targets(eventType string, payload map[string]interface{}, at time.Time) ([]Target, error) {
+	e := events.Event{
+		UserID:      uintField(payload, "user_id"),
+		OrderNumber: stringField(payload, "order"),
+		Status:      stringField(payload, "status"),
+		Amount:      floatField(payload, "amount"),
+		Kind:        stringField(payload, "kind"),
+		Time:        at,
+	}
+
+	var result []events.Event
+	switch {
+	case eventType == events.OrderStatusChanged && e.Status == "PROCESSED":
+		e.Type = OrderProcessed
+		e.Amount = floatField(payload, "accrual")
+		result = append(result, e)
+	case eventType == events.OrderStatusChanged && e.Status == "INVALID":
+		e.Type = OrderInvalid
+		result = append(result, e)
+	case eventType == events.BalanceWithdrawn:
+		e.Type = BalanceWithdrawn
+		result = append(result, e)
+	case eventType == events.BalanceRefunded:
+		e.Type = BalanceRefunded
+		result = append(result, e)
+	case eventType == events.BalanceTransferred:
+		e.Type = BalanceTransferred
+		out, in := e, e
+		out.UserID, out.Status = uintField(payload, "sender_id"), "OUT"
+		in.UserID, in.Status = uintField(payload, "recipient_id"), "IN"
+		result = append(result, out, in)
+	}
+
+	targets := make([]Target, 0, len(result))
+	for _, v := range result {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, Target{UserID: v.UserID, EventType: v.Type, Payload: data})
+	}
+
+	return targets, nil
+}
+
+func uintField(payload map[string]interface{}, key string) uint64 {
+	switch v := payload[key].(type) {
+	case uint64:
+		return v
+	case int64:
+		return uint64(v)
+	case int:
+		return uint64(v)
+	default:
+		return 0
+	}
+}
+
+func stringField(payload map[string]interface{}, key string) string {
+	s, _ := payload[key].(string)
+	return s
+}
+
+func floatField(payload map[string]interface{}, key string) float64 {
+	f, _ := payload[key].(float64)
+	return f
+}
+
+// generateSecret returns a random hex encoded signing secret
+func generateSecret() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key), nil
+}
+
+// sign returns the signature header value for the request body sent at timestamp.
+// Receivers recompute HMAC-SHA256 of "<timestamp>.<body>" with the webhook secret.
+func sign(secret []byte, timestamp int64, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%d.", timestamp)
+	h.Write(body)
+
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// backoff returns the delay before the next attempt: 2^attempt seconds, capped.
+func backoff(attempt int) time.Duration {
+	if attempt > 12 {
+		return maxBackoff
+	}
+
+	d := time.Duration(1<<attempt) * time.Second
+	if d > maxBackoff {
+		return maxBackoff
+	}
+
+	return d
+}
@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/events"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url string
+		err error
+	}{
+		{"https://8.8.8.8/hook", nil},
+		{"ftp://8.8.8.8/hook", ErrInvalidURL},
+		{"/hook", ErrInvalidURL},
+		{"http://127.0.0.1:8080/hook", ErrPrivateAddress},
+		{"http://[::1]/hook", ErrPrivateAddress},
+		{"http://169.254.169.254/latest/meta-data", ErrPrivateAddress},
+		{"http://localhost/hook", ErrPrivateAddress},
+	}
+
+	for _, tt := range tests {
+		err := validateURL(context.Background(), tt.url)
+		if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("validateURL(%s) = %v, want %v", tt.url, err, tt.err)
+		}
+	}
+}
+
+func TestPublicOnly(t *testing.T) {
+	if err := publicOnly("tcp", "8.8.8.8:443", nil); err != nil {
+		t.Errorf("public address refused: %v", err)
+	}
+	if err := publicOnly("tcp", "10.0.0.1:80", nil); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("private address dialed: %v", err)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	at := time.Now()
+
+	targets, err := Targets(events.OrderStatusChanged, map[string]interface{}{
+		"user_id": uint64(7), "order": "12345678903", "status": "PROCESSING", "accrual": 0.0,
+	}, at)
+	if err != nil || len(targets) != 0 {
+		t.Fatalf("PROCESSING order targets = %v, %v, want none", targets, err)
+	}
+
+	targets, err = Targets(events.OrderStatusChanged, map[string]interface{}{
+		"user_id": uint64(7), "order": "12345678903", "status": "PROCESSED", "accrual": 500.5,
+	}, at)
+	if err != nil || len(targets) != 1 {
+		t.Fatalf("PROCESSED order targets = %v, %v, want one", targets, err)
+	}
+	var e events.Event
+	if err = json.Unmarshal(targets[0].Payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	if targets[0].UserID != 7 || e.Type != OrderProcessed || e.OrderNumber != "12345678903" || e.Amount != 500.5 {
+		t.Errorf("PROCESSED order target = %+v, payload %+v", targets[0], e)
+	}
+
+	targets, err = Targets(events.BalanceTransferred, map[string]interface{}{
+		"transfer_id": uint64(1), "sender_id": uint64(3), "recipient_id": uint64(4), "amount": 10.0,
+	}, at)
+	if err != nil || len(targets) != 2 {
+		t.Fatalf("transfer targets = %v, %v, want two", targets, err)
+	}
+	if targets[0].UserID != 3 || targets[1].UserID != 4 || targets[0].EventType != BalanceTransferred {
+		t.Errorf("transfer targets = %+v", targets)
+	}
+}
@@ -0,0 +1,259 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/moorzeen/loyalty-service/internal/storage"
+)
+
+// webhook event types
+const (
+	OrderProcessed     = "order.processed"
+	OrderInvalid       = "order.invalid"
+	BalanceWithdrawn   = "balance.withdrawn"
+	BalanceRefunded    = "balance.refunded"
+	BalanceTransferred = "balance.transferred"
+)
+
+// outbox entry statuses
+const (
+	statusPending   = "PENDING"
+	statusDelivered = "DELIVERED"
+	statusFailed    = "FAILED"
+)
+
+const (
+	EventHeader     = "X-Loyalty-Event"
+	TimestampHeader = "X-Loyalty-Timestamp"
+	SignatureHeader = "X-Loyalty-Signature"
+
+	maxAttempts   = 10
+	maxBackoff    = time.Hour
+	claimBatch    = 10
+	claimLease    = time.Minute
+	deliveriesMax = 100
+)
+
+type Service struct {
+	storage storage.Service
+	client  *http.Client
+	tick    *time.Ticker // Тикер для проверки исходящих сообщений
+}
+
+type Webhook struct {
+	ID         uint64    `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"events"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Delivery struct {
+	MessageID   uint64    `json:"message_id"`
+	EventType   string    `json:"event"`
+	Attempt     int       `json:"attempt"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// newClient returns the delivery client, which dials public addresses only
+// and ignores proxy settings, so the check sees the webhook host itself.
+func newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: publicOnly}
+
+	return &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+}
+
+// NewService starts delivering webhook events, which the storage enqueues
+// with the outbox messages, see Targets.
+func NewService(str storage.Service) Service {
+	wh := Service{
+		storage: str,
+		client:  newClient(),
+		tick:    time.NewTicker(time.Second),
+	}
+
+	go wh.deliver()
+
+	return wh
+}
+
+// Register adds a user webhook. The signing secret is returned only here.
+func (s *Service) Register(ctx context.Context, userID uint64, url string, eventTypes []string) (*Webhook, error) {
+	if err := validateURL(ctx, url); err != nil {
+		return nil, err
+	}
+
+	if len(eventTypes) == 0 {
+		return nil, ErrNoEventTypes
+	}
+	for _, t := range eventTypes {
+		if !isEventType(t) {
+			return nil, fmt.Errorf("%w \"%s\"", ErrUnknownEventType, t)
+		}
+	}
+
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	hook := storage.Webhook{
+		UserID:     userID,
+		URL:        url,
+		Secret:     []byte(secret),
+		EventTypes: eventTypes,
+	}
+
+	id, err := s.storage.AddWebhook(ctx, hook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Webhook{
+		ID:         id,
+		URL:        url,
+		EventTypes: eventTypes,
+		Secret:     secret,
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+func (s *Service) List(ctx context.Context, userID uint64) ([]Webhook, error) {
+	hooks, err := s.storage.GetWebhooks(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Webhook, 0, len(hooks))
+	for _, v := range hooks {
+		item := Webhook{
+			ID:         v.ID,
+			URL:        v.URL,
+			EventTypes: v.EventTypes,
+			CreatedAt:  v.CreatedAt,
+		}
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+func (s *Service) Delete(ctx context.Context, userID uint64, id uint64) error {
+	deleted, err := s.storage.DeleteWebhook(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+// Deliveries returns the latest delivery attempts of the user webhook.
+func (s *Service) Deliveries(ctx context.Context, userID uint64, id uint64) ([]Delivery, error) {
+	deliveries, err := s.storage.GetWebhookDeliveries(ctx, userID, id, deliveriesMax)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Delivery, 0, len(deliveries))
+	for _, v := range deliveries {
+		item := Delivery{
+			MessageID:   v.OutboxID,
+			EventType:   v.EventType,
+			Attempt:     v.Attempt,
+			StatusCode:  v.StatusCode,
+			Error:       v.Error,
+			AttemptedAt: v.AttemptedAt,
+		}
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+// deliver sends due outbox messages every tick.
+func (s *Service) deliver() {
+	for range s.tick.C {
+		ctx := context.Background()
+
+		messages, err := s.storage.ClaimWebhookMessages(ctx, claimBatch, claimLease)
+		if err != nil {
+			slog.Error("Failed to claim webhook messages", "error", err)
+			continue
+		}
+
+		for _, m := range messages {
+			s.send(ctx, m)
+		}
+	}
+}
+
+func (s *Service) send(ctx context.Context, m storage.WebhookMessage) {
+	d := storage.WebhookDelivery{
+		OutboxID: m.ID,
+		Attempt:  m.Attempts + 1,
+	}
+
+	statusCode, err := s.post(ctx, m)
+	d.StatusCode = statusCode
+	if err != nil {
+		d.Error = err.Error()
+	}
+
+	status := statusPending
+	retryAt := time.Now().Add(backoff(d.Attempt))
+	switch {
+	case err == nil:
+		status = statusDelivered
+	case d.Attempt >= maxAttempts:
+		status = statusFailed
+		slog.WarnContext(ctx, "Webhook delivery failed", "webhook_id", m.WebhookID, "message_id", m.ID, "attempts", d.Attempt, "error", err)
+	}
+
+	err = s.storage.CompleteWebhookMessage(ctx, d, status, retryAt)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save webhook delivery", "error", err)
+	}
+}
+
+func (s *Service) post(ctx context.Context, m storage.WebhookMessage) (int, error) {
+	ts := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.URL, bytes.NewReader(m.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, m.EventType)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(SignatureHeader, sign(m.Secret, ts, m.Payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}